@@ -3,7 +3,6 @@ package fupload
 
 import (
   "strings"
-  "io/ioutil"
   "net/http"
   "encoding/json"
   "mime/multipart"
@@ -67,22 +66,19 @@ func sendFileBlobs(c *blobserv.Client, part *multipart.Part) (respMeta map[strin
   meta.RcasObjectRef = obj.Ref()
   meta.Name = part.FileName()
 
-  data, err := ioutil.ReadAll(part)
+  up := c.NewUploader()
+  up.SkipExisting = true
+  err := meta.LoadFromReader(part, up.Put)
+  if cerr := up.Close(); err == nil {
+    err = cerr
+  }
   util.Check(err)
 
-  meta.Size = int64(len(data))
-
-  blobs := blob.SplitRaw(data, blob.DefaultChunkSize)
-  meta.ContentRefs = blob.RefsFor(blobs)
-
   m, err := blob.Marshal(meta)
   util.Check(err)
 
-  blobs = append(blobs, m, obj)
-  for _, b := range blobs {
-    err = c.PutBlob(b)
-    util.Check(err)
-  }
+  err = c.PutBlobs(m, obj)
+  util.Check(err)
 
   return respMeta
 }
@@ -1 +1,18 @@
 
+// share buttons fetch a signed, expiring link to their photo
+var btns = document.getElementsByClassName("share-btn");
+for (var i = 0; i < btns.length; i++) {
+  btns[i].onclick = function() {
+    var req = new XMLHttpRequest();
+    req.open("GET", "share/" + this.getAttribute("data-ref"), true);
+    req.setRequestHeader("X-Requested-With", "XMLHttpRequest");
+    req.onload = function() {
+      if (req.status == 200) {
+        window.prompt("Link to share (expires in a week):", req.responseText);
+      } else {
+        alert("could not create share link");
+      }
+    };
+    req.send();
+  };
+}
@@ -36,6 +36,20 @@ func (ind *Index) Newest(n int) (objrefs []string) {
   return ind.PhotoRefs[l-n:]
 }
 
+// Updated returns the time up to which photos have been added.
+func (ind *Index) Updated() time.Time {
+  ind.lock.RLock()
+  defer ind.lock.RUnlock()
+  return ind.LastUpdate
+}
+
+// SetUpdated records that photos have been added up to time t.
+func (ind *Index) SetUpdated(t time.Time) {
+  ind.lock.Lock()
+  defer ind.lock.Unlock()
+  ind.LastUpdate = t
+}
+
 func (ind *Index) Len() int {
   return len(ind.PhotoRefs)
 }
@@ -2,9 +2,10 @@
 package pics
 
 import (
+  "io"
   "time"
+  "sync"
   "strings"
-  "mime"
   "net/http"
   "html/template"
   "path"
@@ -15,18 +16,24 @@ import (
   "github.com/rwcarlsen/cas/appserv"
 )
 
+// shareTTL is how long links made by the share button work.
+const shareTTL = 7 * 24 * time.Hour
+
+// resubscribeDelay is how long to wait before retrying a failed
+// subscription to new uploads.
+const resubscribeDelay = 10 * time.Second
+
 var picIndex *photos.Index
 var c *blobserv.Client
+var ready bool
+var initLock sync.Mutex
+
 func Handler(nc *blobserv.Client, w http.ResponseWriter, r *http.Request) {
   defer util.DeferWrite(w)
-  c = nc
 
-  tmpl := template.Must(template.ParseFiles(appserv.Static("pics/index.tmpl")))
+  setup(nc)
 
-  if picIndex == nil {
-    loadPicIndex()
-  }
-  updateIndex()
+  tmpl := template.Must(template.ParseFiles(appserv.Static("pics/index.tmpl")))
 
   pth := strings.Trim(r.URL.Path, "/")
   if pth == "pics" {
@@ -40,62 +47,120 @@ func Handler(nc *blobserv.Client, w http.ResponseWriter, r *http.Request) {
     fblob, err := c.ObjectTip(ref)
     util.Check(err)
 
-    m, data, err := c.ReconstituteFile(fblob.Ref())
+    // relay the blobserver's ranged response so videos can seek
+    resp, err := c.OpenFile(fblob.Ref(), r.Header)
     util.Check(err)
+    defer resp.Body.Close()
 
-    ext := path.Ext(m.Name)
-    w.Header().Set("Content-Type", mime.TypeByExtension(ext))
-    w.Write(data)
+    for _, k := range []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "ETag", "Last-Modified"} {
+      if v := resp.Header.Get(k); v != "" {
+        w.Header().Set(k, v)
+      }
+    }
+    w.WriteHeader(resp.StatusCode)
+    io.Copy(w, resp.Body)
+  } else if strings.HasPrefix(pth, "pics/share/") {
+    objref := path.Base(pth)
+    tip, err := c.ObjectTip(objref)
+    util.Check(err)
+
+    link, err := c.SignURL(tip.Ref(), objref, shareTTL)
+    util.Check(err)
+    w.Write([]byte(link))
   } else {
     err := util.LoadStatic(appserv.Static(pth), w)
     util.Check(err)
   }
 }
 
-func updateIndex() {
-  nBlobs := 50
-  for skip := 0; true; skip += nBlobs {
-    blobs, err := c.BlobsForward(picIndex.LastUpdate, nBlobs, skip)
+// setup loads the index and starts the only watcher on the first request.
+// It panics if the index can't be loaded so the request fails and the next
+// one tries again.
+func setup(nc *blobserv.Client) {
+  initLock.Lock()
+  defer initLock.Unlock()
+  if ready {
+    return
+  }
+
+  c = nc
+  ind, err := loadPicIndex()
+  util.Check(err)
+  picIndex, ready = ind, true
+  go watchIndex()
+}
+
+// watchIndex adds photos to the index as they are uploaded. If the
+// blobserver ends the subscription, photos stored in the meantime are
+// caught up on with updateIndex.
+func watchIndex() {
+  for {
+    refs, err := c.Subscribe(blob.MetaType, "", nil)
     if err != nil {
-      break
+      time.Sleep(resubscribeDelay)
+      continue
     }
 
-    //picIndex.Notify(blobs...)
-
-    if len(blobs) < nBlobs {
-      break
+    updateIndex()
+    for ref := range refs {
+      if b, err := c.GetBlob(ref); err == nil {
+        addPhoto(b)
+      }
     }
   }
 }
 
-func loadPicIndex() {
-  nBlobs := 10
+func updateIndex() {
+  since := time.Now()
+  nBlobs := 50
   for skip := 0; true; skip += nBlobs {
-    blobs, err := c.BlobsBackward(time.Now(), nBlobs, skip)
+    blobs, err := c.BlobsForward(picIndex.Updated(), nBlobs, skip)
     if err != nil {
-      break
+      return
     }
+
     for _, b := range blobs {
-      if b.Type() == photos.IndexType {
-        err := blob.Unmarshal(b, picIndex)
-        util.Check(err)
-        return
-      }
+      addPhoto(b)
     }
 
     if len(blobs) < nBlobs {
       break
     }
   }
+  picIndex.SetUpdated(since)
+}
+
+// addPhoto adds b to the index if it is the meta of an image.
+func addPhoto(b *blob.Blob) {
+  m := &blob.Meta{}
+  if b.Type() != blob.MetaType || blob.Unmarshal(b, m) != nil {
+    return
+  } else if photos.IsValidImage(m) && m.RcasObjectRef != "" {
+    picIndex.AddPhoto(m.RcasObjectRef, &photos.Photo{})
+  }
+}
+
+// loadPicIndex returns the newest stored photo index. A new one is only
+// created if the blobserver has none, not if it couldn't be asked.
+func loadPicIndex() (*photos.Index, error) {
+  ind := photos.NewIndex()
+  blobs, err := c.NewestOfType(photos.IndexType, 1, 0)
+  if err == nil {
+    if err := blob.Unmarshal(blobs[0], ind); err != nil {
+      return nil, err
+    }
+    return ind, nil
+  } else if err != blobserv.NoResultsErr {
+    return nil, err
+  }
 
   // no pre-existing photo index found
-  picIndex = photos.NewIndex()
   obj := blob.NewObject()
-  picIndex.RcasObjectRef = obj.Ref()
-  err := c.PutBlob(obj)
-  if err != nil {
-    panic("pics: could not create photo index")
+  ind.RcasObjectRef = obj.Ref()
+  if err := c.PutBlob(obj); err != nil {
+    return nil, err
   }
+  return ind, nil
 }
 
 func picForObj(ref string) *photos.Photo {
@@ -111,7 +176,7 @@ func picLinks(refs []string) map[string]*photos.Photo {
   links := map[string]*photos.Photo{}
   for _, ref := range refs {
     // fix this to not be a blank photo TODO
-    links["ref/" + ref + ".photo"] = &photos.Photo{}
+    links[ref] = &photos.Photo{}
   }
   return links
 }
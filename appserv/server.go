@@ -15,7 +15,7 @@ import (
 )
 
 const tmplDir = "templates"
-var defaultClient *blobserv.Client = &blobserv.Client{"https://0.0.0.0:7777", "robert", "password"}
+var defaultClient *blobserv.Client = &blobserv.Client{Host: "https://0.0.0.0:7777"}
 
 type HandleFunc func(*blobserv.Client, http.ResponseWriter, *http.Request)
 var handlers = make(map[string]HandleFunc)
@@ -33,6 +33,12 @@ func SetStatic(path string) {
   static = path
 }
 
+// SetClient sets the blobserver client (and credentials) passed to app
+// handlers.
+func SetClient(c *blobserv.Client) {
+  defaultClient = c
+}
+
 func RegisterApp(name string, h HandleFunc) error {
   if _, ok := handlers[name]; ok {
     return errors.New("Registration failed: duplicate app name.")
@@ -17,6 +17,7 @@ limitations under the License.
 package auth
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"net/http"
@@ -27,9 +28,62 @@ import (
 var kBasicAuthPattern *regexp.Regexp = regexp.MustCompile(`^Basic ([a-zA-Z0-9\+/=]+)`)
 
 var (
-  mode = &UserPass{Username: "robert", Password: "password"}
+  users = newUserStore("")
+  keys = NewKeyring()
 )
 
+// SetUsers makes the accounts in us the ones authorized by Handler and
+// RequireAuth. No one is authorized until it is called.
+func SetUsers(us *UserStore) {
+  users = us
+}
+
+// SetKeyring makes the keys in kr the ones whose signed requests are
+// authorized by Handler and RequireAuth.
+func SetKeyring(kr *Keyring) {
+  keys = kr
+}
+
+type identityKey struct{}
+
+// authenticate returns the user name or key id of a request signed by an
+// authorized key or carrying a user's credentials along with its role.
+// NoRole is returned for anonymous and badly authenticated requests.
+func authenticate(req *http.Request) (id string, r Role) {
+  if req.Header.Get(SigHeader) != "" {
+    r, err := keys.Verify(req)
+    if err != nil {
+      return "", NoRole
+    }
+    return req.Header.Get(KeyHeader), r
+  }
+
+  user, pass, err := basicAuth(req)
+  if err != nil {
+    return "", NoRole
+  }
+  if r := users.Authenticate(user, pass); r != NoRole {
+    return user, r
+  }
+  return "", NoRole
+}
+
+// Identity returns the user name or key id that authenticated a request
+// passed through Handler. It is empty for anonymous requests. Handlers'
+// Unauthorized methods can use it for requests that authenticated with
+// too low a role.
+func Identity(req *http.Request) string {
+  id, _ := req.Context().Value(identityKey{}).(string)
+  return id
+}
+
+func withIdentity(req *http.Request, id string) *http.Request {
+  if id == "" {
+    return req
+  }
+  return req.WithContext(context.WithValue(req.Context(), identityKey{}, id))
+}
+
 func basicAuth(req *http.Request) (string, string, error) {
 	auth := req.Header.Get("Authorization")
 	if auth == "" {
@@ -53,20 +107,6 @@ func basicAuth(req *http.Request) (string, string, error) {
 	return pieces[0], pieces[1], nil
 }
 
-// UserPass is used when the auth string provided in the config
-// is of the kind "userpass:username:pass"
-type UserPass struct {
-	Username, Password string
-}
-
-func (up *UserPass) IsAuthorized(req *http.Request) bool {
-	user, pass, err := basicAuth(req)
-	if err != nil {
-		return false
-	}
-	return user == up.Username && pass == up.Password
-}
-
 func SendUnauthorized(conn http.ResponseWriter) {
 	realm := "rcas"
 	conn.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
@@ -74,11 +114,17 @@ func SendUnauthorized(conn http.ResponseWriter) {
 	fmt.Fprintf(conn, "<h1>Unauthorized</h1>")
 }
 
+// SendForbidden rejects a request whose credentials don't permit it.
+func SendForbidden(conn http.ResponseWriter) {
+  conn.WriteHeader(http.StatusForbidden)
+  fmt.Fprintf(conn, "<h1>Forbidden</h1>")
+}
+
 // RequireAuth wraps a function with another function that enforces
 // HTTP Basic Auth.
 func RequireAuth(handler func(conn http.ResponseWriter, req *http.Request)) func(conn http.ResponseWriter, req *http.Request) {
 	return func(conn http.ResponseWriter, req *http.Request) {
-		if mode.IsAuthorized(req) {
+		if _, r := authenticate(req); r >= ReadRole {
 			handler(conn, req)
 		} else {
 			SendUnauthorized(conn)
@@ -91,12 +137,17 @@ type AuthHandler interface {
   Unauthorized(http.ResponseWriter, *http.Request)
 }
 
+// Handler serves requests from users with at least role Role and hands
+// all others to the wrapped handler's Unauthorized method.
 type Handler struct {
   AuthHandler
+  Role Role
 }
 
 func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-  if mode.IsAuthorized(r) {
+  id, role := authenticate(r)
+  r = withIdentity(r, id)
+  if role != NoRole && role >= h.Role {
     h.AuthHandler.ServeHTTP(w, r)
   } else {
     h.AuthHandler.Unauthorized(w, r)
@@ -0,0 +1,340 @@
+package auth
+
+import (
+  "io"
+  "os"
+  "fmt"
+  "time"
+  "sync"
+  "bufio"
+  "bytes"
+  "errors"
+  "strings"
+  "strconv"
+  "net/http"
+  "io/ioutil"
+  "crypto"
+  "crypto/rand"
+  "crypto/rsa"
+  "crypto/sha256"
+  "crypto/ed25519"
+  "crypto/x509"
+  "encoding/hex"
+  "encoding/pem"
+  "encoding/base64"
+)
+
+// Headers carrying a request signature.
+const (
+  KeyHeader = "X-Rcas-Key"
+  TimeHeader = "X-Rcas-Timestamp"
+  NonceHeader = "X-Rcas-Nonce"
+  BodyHashHeader = "X-Rcas-Content-Sha256"
+  SigHeader = "X-Rcas-Signature"
+)
+
+// MaxSkew is how far a signed request's timestamp may be from the server's
+// clock. Nonces are remembered for this long on either side to reject
+// replays.
+const MaxSkew = 5 * time.Minute
+
+// MaxBodySize is the largest signed request body that is read: a 64 Mb
+// blob (blobserv.MaxBlobSize) plus request framing.
+const MaxBodySize = 65 << 20
+
+var (
+  UnsupportedKeyErr = errors.New("auth: unsupported key type (need ed25519 or rsa)")
+  BadSigErr = errors.New("auth: bad request signature")
+  ReplayErr = errors.New("auth: request nonce already used")
+  BodyTooLargeErr = errors.New("auth: signed request body is larger than MaxBodySize")
+)
+
+// signingString is the message signed for a request.
+func signingString(req *http.Request) []byte {
+  return []byte(strings.Join([]string{
+    req.Method,
+    req.URL.RequestURI(),
+    req.Header.Get(BodyHashHeader),
+    req.Header.Get(TimeHeader),
+    req.Header.Get(NonceHeader),
+  }, "\n"))
+}
+
+// SignRequest signs the method, path, query, body hash, timestamp and a
+// random nonce of req with key identified on the server as keyID. body
+// must be the request body.
+func SignRequest(req *http.Request, keyID string, key crypto.Signer, body []byte) error {
+  nonce := make([]byte, 16)
+  if _, err := rand.Read(nonce); err != nil {
+    return err
+  }
+  sum := sha256.Sum256(body)
+
+  req.Header.Set(KeyHeader, keyID)
+  req.Header.Set(TimeHeader, strconv.FormatInt(time.Now().Unix(), 10))
+  req.Header.Set(NonceHeader, hex.EncodeToString(nonce))
+  req.Header.Set(BodyHashHeader, hex.EncodeToString(sum[:]))
+
+  msg := signingString(req)
+  var sig []byte
+  var err error
+  switch key.Public().(type) {
+  case ed25519.PublicKey:
+    sig, err = key.Sign(rand.Reader, msg, crypto.Hash(0))
+  case *rsa.PublicKey:
+    digest := sha256.Sum256(msg)
+    sig, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+  default:
+    return UnsupportedKeyErr
+  }
+  if err != nil {
+    return err
+  }
+
+  req.Header.Set(SigHeader, base64.StdEncoding.EncodeToString(sig))
+  return nil
+}
+
+func verifySig(pub crypto.PublicKey, msg, sig []byte) bool {
+  switch k := pub.(type) {
+  case ed25519.PublicKey:
+    return ed25519.Verify(k, msg, sig)
+  case *rsa.PublicKey:
+    digest := sha256.Sum256(msg)
+    return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil
+  }
+  return false
+}
+
+// PubKey is an authorized public key and the role requests signed with
+// it are granted.
+type PubKey struct {
+  ID string
+  Role Role
+  Key crypto.PublicKey
+}
+
+// Keyring holds the public keys allowed to sign requests.
+type Keyring struct {
+  keys map[string]*PubKey
+  nonces map[string]time.Time // nonce -> time it may be forgotten
+  lock sync.Mutex
+}
+
+func NewKeyring() *Keyring {
+  return &Keyring{
+    keys: map[string]*PubKey{},
+    nonces: map[string]time.Time{},
+  }
+}
+
+// LoadKeyring reads a keyring file. Each non-blank line that does not
+// start with '#' is "<id> <role> <key>" where key is a base64 PKIX
+// encoded public key (see MarshalPublicKey). A missing file is treated as
+// an empty keyring.
+func LoadKeyring(path string) (*Keyring, error) {
+  kr := NewKeyring()
+
+  f, err := os.Open(path)
+  if os.IsNotExist(err) {
+    return kr, nil
+  } else if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+
+  scan := bufio.NewScanner(f)
+  for n := 1; scan.Scan(); n++ {
+    line := strings.TrimSpace(scan.Text())
+    if line == "" || strings.HasPrefix(line, "#") {
+      continue
+    }
+
+    fields := strings.Fields(line)
+    if len(fields) != 3 {
+      return nil, fmt.Errorf("auth: %v:%v: malformed keyring entry", path, n)
+    }
+    r, err := ParseRole(fields[1])
+    if err != nil {
+      return nil, fmt.Errorf("auth: %v:%v: %v", path, n, err)
+    }
+    pub, err := ParsePublicKey(fields[2])
+    if err != nil {
+      return nil, fmt.Errorf("auth: %v:%v: %v", path, n, err)
+    }
+    kr.Add(&PubKey{ID: fields[0], Role: r, Key: pub})
+  }
+  return kr, scan.Err()
+}
+
+// Add authorizes k, replacing any key with the same ID.
+func (kr *Keyring) Add(k *PubKey) {
+  kr.lock.Lock()
+  defer kr.lock.Unlock()
+  kr.keys[k.ID] = k
+}
+
+// Has returns true if a key with ID id is authorized.
+func (kr *Keyring) Has(id string) bool {
+  kr.lock.Lock()
+  defer kr.lock.Unlock()
+  _, ok := kr.keys[id]
+  return ok
+}
+
+// Len returns the number of authorized keys.
+func (kr *Keyring) Len() int {
+  kr.lock.Lock()
+  defer kr.lock.Unlock()
+  return len(kr.keys)
+}
+
+// Verify checks the signature headers of req and returns the role of the
+// signing key. The request body is read and replaced so handlers can
+// still read it.
+func (kr *Keyring) Verify(req *http.Request) (Role, error) {
+  id := req.Header.Get(KeyHeader)
+  kr.lock.Lock()
+  k, ok := kr.keys[id]
+  kr.lock.Unlock()
+  if !ok {
+    return NoRole, BadSigErr
+  }
+
+  secs, err := strconv.ParseInt(req.Header.Get(TimeHeader), 10, 64)
+  if err != nil {
+    return NoRole, BadSigErr
+  }
+  t := time.Unix(secs, 0)
+  now := time.Now()
+  if t.Before(now.Add(-MaxSkew)) || t.After(now.Add(MaxSkew)) {
+    return NoRole, BadSigErr
+  }
+
+  // the body hash is signed, so the body is only read (and at most
+  // MaxBodySize of it) for requests from the key holder
+  sig, err := base64.StdEncoding.DecodeString(req.Header.Get(SigHeader))
+  if err != nil || !verifySig(k.Key, signingString(req), sig) {
+    return NoRole, BadSigErr
+  }
+
+  var body []byte
+  if req.Body != nil {
+    body, err = ioutil.ReadAll(io.LimitReader(req.Body, MaxBodySize + 1))
+    req.Body.Close()
+    if err != nil {
+      return NoRole, err
+    } else if len(body) > MaxBodySize {
+      return NoRole, BodyTooLargeErr
+    }
+    req.Body = ioutil.NopCloser(bytes.NewReader(body))
+  }
+  sum := sha256.Sum256(body)
+  if req.Header.Get(BodyHashHeader) != hex.EncodeToString(sum[:]) {
+    return NoRole, BadSigErr
+  }
+
+  // only remember nonces of validly signed requests so they can't be used
+  // to flood the nonce table
+  if !kr.useNonce(id + ":" + req.Header.Get(NonceHeader), now) {
+    return NoRole, ReplayErr
+  }
+  return k.Role, nil
+}
+
+func (kr *Keyring) useNonce(nonce string, now time.Time) bool {
+  kr.lock.Lock()
+  defer kr.lock.Unlock()
+
+  for n, expire := range kr.nonces {
+    if now.After(expire) {
+      delete(kr.nonces, n)
+    }
+  }
+
+  if _, ok := kr.nonces[nonce]; ok {
+    return false
+  }
+  kr.nonces[nonce] = now.Add(2 * MaxSkew)
+  return true
+}
+
+// IsAuthorized returns true if req is signed by a key with at least
+// role r.
+func (kr *Keyring) IsAuthorized(req *http.Request, r Role) bool {
+  if req.Header.Get(SigHeader) == "" {
+    return false
+  }
+  role, err := kr.Verify(req)
+  return err == nil && role != NoRole && role >= r
+}
+
+// MarshalPublicKey returns the keyring encoding of pub.
+func MarshalPublicKey(pub crypto.PublicKey) (string, error) {
+  der, err := x509.MarshalPKIXPublicKey(pub)
+  if err != nil {
+    return "", err
+  }
+  return base64.StdEncoding.EncodeToString(der), nil
+}
+
+// ParsePublicKey decodes a public key encoded by MarshalPublicKey.
+func ParsePublicKey(s string) (crypto.PublicKey, error) {
+  der, err := base64.StdEncoding.DecodeString(s)
+  if err != nil {
+    return nil, err
+  }
+  pub, err := x509.ParsePKIXPublicKey(der)
+  if err != nil {
+    return nil, err
+  }
+
+  switch pub.(type) {
+  case ed25519.PublicKey, *rsa.PublicKey:
+    return pub, nil
+  }
+  return nil, UnsupportedKeyErr
+}
+
+// GenerateKey writes a new PEM encoded ed25519 private key to w.
+func GenerateKey(w io.Writer) (crypto.Signer, error) {
+  _, priv, err := ed25519.GenerateKey(rand.Reader)
+  if err != nil {
+    return nil, err
+  }
+  der, err := x509.MarshalPKCS8PrivateKey(priv)
+  if err != nil {
+    return nil, err
+  }
+  return priv, pem.Encode(w, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// LoadPrivateKey reads a PEM encoded PKCS#8 (ed25519 or rsa) or PKCS#1
+// (rsa) private key.
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+
+  block, _ := pem.Decode(data)
+  if block == nil {
+    return nil, errors.New("auth: no PEM data in " + path)
+  }
+
+  if block.Type == "RSA PRIVATE KEY" {
+    return x509.ParsePKCS1PrivateKey(block.Bytes)
+  }
+
+  key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+  if err != nil {
+    return nil, err
+  }
+  switch k := key.(type) {
+  case ed25519.PrivateKey:
+    return k, nil
+  case *rsa.PrivateKey:
+    return k, nil
+  }
+  return nil, UnsupportedKeyErr
+}
@@ -0,0 +1,333 @@
+package auth
+
+import (
+  "os"
+  "fmt"
+  "crypto/hmac"
+  "sort"
+  "sync"
+  "errors"
+  "strings"
+  "net/http"
+  "io/ioutil"
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/subtle"
+  "crypto/pbkdf2"
+  "encoding/hex"
+  "encoding/json"
+  "path/filepath"
+)
+
+const (
+  // DefaultIter is the number of pbkdf2 rounds used when hashing new
+  // passwords.
+  DefaultIter = 600000
+  // maxHashing is the number of pbkdf2 password checks run at once. Users
+  // whose credentials are cached never wait on it.
+  maxHashing = 2
+)
+
+var (
+  DupUserErr = errors.New("auth: user already exists")
+  NoUserErr = errors.New("auth: no such user")
+  BadRoleErr = errors.New("auth: unknown role")
+)
+
+// Role is a user's level of access. Each role includes the access of the
+// roles below it.
+type Role int
+
+const (
+  NoRole Role = iota
+  GuestRole // only use shares granted to the user (see blob.Share.Grantee)
+  ReadRole // retrieve blobs and query indexes
+  WriteRole // also store blobs
+  AdminRole // everything
+)
+
+var roleNames = []string{"none", "guest", "read", "write", "admin"}
+
+func (r Role) String() string {
+  if r < 0 || int(r) >= len(roleNames) {
+    return fmt.Sprint("Role(", int(r), ")")
+  }
+  return roleNames[r]
+}
+
+// ParseRole returns the role named s (guest, read, write or admin).
+func ParseRole(s string) (Role, error) {
+  for i, name := range roleNames {
+    if i > 0 && name == strings.ToLower(s) {
+      return Role(i), nil
+    }
+  }
+  return NoRole, BadRoleErr
+}
+
+func (r Role) MarshalText() ([]byte, error) {
+  return []byte(r.String()), nil
+}
+
+func (r *Role) UnmarshalText(text []byte) (err error) {
+  *r, err = ParseRole(string(text))
+  return err
+}
+
+// User is a stored account. Only a salted pbkdf2 hash of the password is
+// kept.
+type User struct {
+  Name string
+  Role Role
+  Salt string
+  Hash string
+  Iter int
+}
+
+func (u *User) setPassword(pass string) error {
+  salt := make([]byte, 16)
+  if _, err := rand.Read(salt); err != nil {
+    return err
+  }
+  u.Salt = hex.EncodeToString(salt)
+  u.Iter = DefaultIter
+
+  h, err := u.hash(pass)
+  if err != nil {
+    return err
+  }
+  u.Hash = h
+  return nil
+}
+
+func (u *User) hash(pass string) (string, error) {
+  salt, err := hex.DecodeString(u.Salt)
+  if err != nil {
+    return "", err
+  }
+  key, err := pbkdf2.Key(sha256.New, pass, salt, u.Iter, sha256.Size)
+  if err != nil {
+    return "", err
+  }
+  return hex.EncodeToString(key), nil
+}
+
+func (u *User) checkPassword(pass string) bool {
+  h, err := u.hash(pass)
+  if err != nil {
+    return false
+  }
+  return subtle.ConstantTimeCompare([]byte(h), []byte(u.Hash)) == 1
+}
+
+// UserStore is a set of user accounts backed by a json file.
+type UserStore struct {
+  path string
+  users map[string]*User
+  // secret keys the verified macs. It is random and never leaves memory
+  // so the cache is no help in guessing passwords.
+  secret []byte
+  // verified maps user names to the mac (see credMac) of the last
+  // credentials that passed a full pbkdf2 check.
+  verified map[string]string
+  // dummy is checked against for unknown users so they take as long to
+  // reject as wrong passwords.
+  dummy *User
+  hashing chan bool
+  lock sync.RWMutex
+}
+
+func newUserStore(path string) *UserStore {
+  us := &UserStore{
+    path: path,
+    users: map[string]*User{},
+    secret: make([]byte, 32),
+    verified: map[string]string{},
+    hashing: make(chan bool, maxHashing),
+  }
+  if _, err := rand.Read(us.secret); err != nil {
+    panic(err)
+  }
+  // no password hashes to an empty Hash
+  us.dummy = &User{Salt: hex.EncodeToString(us.secret[:16]), Iter: DefaultIter}
+  return us
+}
+
+// credMac returns a digest of user u's credentials. It changes whenever
+// the user's password does.
+func (us *UserStore) credMac(u *User, pass string) string {
+  mac := hmac.New(sha256.New, us.secret)
+  fmt.Fprintf(mac, "%v\x00%v\x00%v", u.Name, u.Hash, pass)
+  return hex.EncodeToString(mac.Sum(nil))
+}
+
+// LoadUsers reads the user store at path. A missing file is treated as an
+// empty store and is created by the first Save.
+func LoadUsers(path string) (*UserStore, error) {
+  us := newUserStore(path)
+
+  data, err := ioutil.ReadFile(path)
+  if os.IsNotExist(err) {
+    return us, nil
+  } else if err != nil {
+    return nil, err
+  }
+
+  users := []*User{}
+  if err := json.Unmarshal(data, &users); err != nil {
+    return nil, err
+  }
+  for _, u := range users {
+    us.users[u.Name] = u
+  }
+  return us, nil
+}
+
+// Save atomically writes the store back to its file.
+func (us *UserStore) Save() error {
+  us.lock.RLock()
+  users := []*User{}
+  for _, u := range us.users {
+    users = append(users, u)
+  }
+  us.lock.RUnlock()
+  sort.Sort(byName(users))
+
+  data, err := json.MarshalIndent(users, "", "  ")
+  if err != nil {
+    return err
+  }
+
+  if err := os.MkdirAll(filepath.Dir(us.path), 0700); err != nil {
+    return err
+  }
+  tmp := us.path + ".tmp"
+  if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+    return err
+  }
+  return os.Rename(tmp, us.path)
+}
+
+// Add creates a new user. Call Save to persist the change.
+func (us *UserStore) Add(name, pass string, r Role) error {
+  us.lock.Lock()
+  defer us.lock.Unlock()
+
+  if _, ok := us.users[name]; ok {
+    return DupUserErr
+  }
+  u := &User{Name: name, Role: r}
+  if err := u.setPassword(pass); err != nil {
+    return err
+  }
+  us.users[name] = u
+  return nil
+}
+
+// Remove deletes the user name. Call Save to persist the change.
+func (us *UserStore) Remove(name string) error {
+  us.lock.Lock()
+  defer us.lock.Unlock()
+
+  if _, ok := us.users[name]; !ok {
+    return NoUserErr
+  }
+  delete(us.users, name)
+  delete(us.verified, name)
+  return nil
+}
+
+// SetPassword resets the password of user name. Call Save to persist the
+// change.
+func (us *UserStore) SetPassword(name, pass string) error {
+  us.lock.Lock()
+  defer us.lock.Unlock()
+
+  u, ok := us.users[name]
+  if !ok {
+    return NoUserErr
+  }
+  delete(us.verified, name)
+  return u.setPassword(pass)
+}
+
+// SetRole changes the role of user name. Call Save to persist the change.
+func (us *UserStore) SetRole(name string, r Role) error {
+  us.lock.Lock()
+  defer us.lock.Unlock()
+
+  u, ok := us.users[name]
+  if !ok {
+    return NoUserErr
+  }
+  u.Role = r
+  return nil
+}
+
+// Users returns the names and roles of all users sorted by name.
+func (us *UserStore) Users() []User {
+  us.lock.RLock()
+  defer us.lock.RUnlock()
+
+  users := []*User{}
+  for _, u := range us.users {
+    users = append(users, u)
+  }
+  sort.Sort(byName(users))
+
+  list := []User{}
+  for _, u := range users {
+    list = append(list, User{Name: u.Name, Role: u.Role})
+  }
+  return list
+}
+
+// Authenticate returns the role of user name if pass is correct and
+// NoRole otherwise. Only the first use of a password (or the first after a
+// different one was used) pays for a full pbkdf2 check.
+func (us *UserStore) Authenticate(name, pass string) Role {
+  us.lock.RLock()
+  p, ok := us.users[name]
+  if !ok {
+    p = us.dummy
+  }
+  u := *p
+  cached := us.verified[name]
+  us.lock.RUnlock()
+
+  mac := us.credMac(&u, pass)
+  if ok && hmac.Equal([]byte(mac), []byte(cached)) {
+    return u.Role
+  }
+
+  us.hashing <- true
+  good := u.checkPassword(pass)
+  <-us.hashing
+  if !ok || !good {
+    return NoRole
+  }
+
+  us.lock.Lock()
+  if p, ok := us.users[name]; ok && p.Hash == u.Hash {
+    us.verified[name] = mac
+  }
+  us.lock.Unlock()
+  return u.Role
+}
+
+// IsAuthorized returns true if the request carries the basic auth
+// credentials of a user with at least role r.
+func (us *UserStore) IsAuthorized(req *http.Request, r Role) bool {
+  user, pass, err := basicAuth(req)
+  if err != nil {
+    return false
+  }
+  role := us.Authenticate(user, pass)
+  return role != NoRole && role >= r
+}
+
+type byName []*User
+
+func (b byName) Len() int { return len(b) }
+func (b byName) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byName) Less(i, j int) bool { return b[i].Name < b[j].Name }
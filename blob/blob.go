@@ -10,6 +10,7 @@ import (
   "encoding/json"
   "time"
   "errors"
+  "sync"
 )
 
 const (
@@ -50,6 +51,27 @@ func init() {
   }
 }
 
+var InvalidRefErr = errors.New("blob: invalid blob ref")
+
+// ParseRef splits ref into its hash function and hex encoded sum.
+func ParseRef(ref string) (h crypto.Hash, sum string, err error) {
+  parts := strings.Split(ref, NameHashSep)
+  if len(parts) != 2 {
+    return 0, "", InvalidRefErr
+  }
+
+  h, ok := name2Hash[parts[0]]
+  if !ok {
+    return 0, "", InvalidRefErr
+  }
+
+  sum = parts[1]
+  if _, err := hex.DecodeString(sum); err != nil || len(sum) != 2 * h.Size() {
+    return 0, "", InvalidRefErr
+  }
+  return h, sum, nil
+}
+
 func HashToName(h crypto.Hash) string {
   return hash2Name[h]
 }
@@ -91,6 +113,16 @@ func Unmarshal(b *Blob, v interface{}) error {
 type Blob struct {
   Hash crypto.Hash
   content []byte
+  hdrOnce sync.Once
+  hdr *Header
+}
+
+// Header holds the universal Rcas* fields of a json blob.
+type Header struct {
+  RcasType string
+  RcasObjectRef string
+  RcasTimestamp string
+  RcasVersion string
 }
 
 // Raw creates a blob using the DefaultHash holding the passed content.
@@ -98,48 +130,68 @@ func NewRaw(content []byte) *Blob {
   return &Blob{Hash: DefaultHash, content: content}
 }
 
+// Header returns the blob's universal meta fields or nil if the blob is not
+// a json object. The content is decoded only once - subsequent calls (e.g.
+// by each index notified of the blob) return the cached header.
+func (b *Blob) Header() *Header {
+  b.hdrOnce.Do(func() {
+    if !looksJson(b.content) {
+      return
+    }
+
+    h := &Header{}
+    if err := json.Unmarshal(b.content, h); err != nil {
+      if _, ok := err.(*json.UnmarshalTypeError); !ok {
+        return
+      }
+    }
+    b.hdr = h
+  })
+  return b.hdr
+}
+
+// looksJson quickly rejects content that can't be a json object so binary
+// chunks are never run through the json decoder.
+func looksJson(data []byte) bool {
+  for _, c := range data {
+    switch c {
+      case ' ', '\t', '\n', '\r':
+        continue
+      case '{':
+        return true
+    }
+    return false
+  }
+  return false
+}
+
 // Type returns the value of the blob.Type field if the object is a valid
 // json blob.
 //
-// It returns const NoType if the field is not present and const Binary
-// if the blob is not valid json
+// It returns const NoType if the field is not present or the blob is not
+// valid json
 func (b *Blob) Type() string {
-  val := b.get(Type)
-  if val == nil {
+  h := b.Header()
+  if h == nil || h.RcasType == "" {
     return NoType
   }
-  return val.(string)
+  return h.RcasType
 }
 
 func (b *Blob) Timestamp() (t time.Time, err error) {
-  tm := b.get(Timestamp)
-  if tm == nil {
+  h := b.Header()
+  if h == nil || h.RcasTimestamp == "" {
     return time.Time{}, errors.New("blob: no time-stamp present")
   }
-  return time.Parse(TimeFormat, tm.(string))
+  return time.Parse(TimeFormat, h.RcasTimestamp)
 }
 
 func (b *Blob) ObjectRef() string {
-  ref := b.get(ObjectRef)
-  if ref == nil {
+  h := b.Header()
+  if h == nil {
     return ""
   }
-  return ref.(string)
-}
-
-func (b *Blob) get(prop string) interface{} {
-  m := map[string]interface{}{}
-  err := Unmarshal(b, &m)
-  if err != nil {
-    return nil
-  }
-
-  val, ok := m[prop]
-  if !ok {
-    return nil
-  }
-
-  return val
+  return h.RcasObjectRef
 }
 
 // Sum returns the hash sum of the blob's content using its hash function
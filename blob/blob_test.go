@@ -0,0 +1,42 @@
+package blob
+
+import (
+  "testing"
+  "math/rand"
+)
+
+// five header field lookups as made by the indexes notified of a blob
+func lookups(b *Blob) {
+  b.Type()
+  b.Timestamp()
+  b.ObjectRef()
+  b.Type()
+  b.ObjectRef()
+}
+
+func BenchmarkMetaFields(b *testing.B) {
+  m := NewMeta()
+  m.Name = "photo.jpg"
+  m.ContentRefs = []string{NewRaw([]byte("a")).Ref(), NewRaw([]byte("b")).Ref()}
+  mb, err := Marshal(m)
+  if err != nil {
+    b.Fatal(err)
+  }
+  data := mb.Content()
+
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    lookups(NewRaw(data))
+  }
+}
+
+func BenchmarkChunkFields(b *testing.B) {
+  data := make([]byte, 1 << 20)
+  rand.New(rand.NewSource(1)).Read(data)
+  data[0] = 'x' // never a json object
+
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    lookups(NewRaw(data))
+  }
+}
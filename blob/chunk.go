@@ -0,0 +1,188 @@
+package blob
+
+import (
+  "io"
+)
+
+const (
+  DefaultMinChunk = 1 << 18 // 256Kb
+  DefaultAvgChunk = 1 << 20 // 1Mb
+  DefaultMaxChunk = 1 << 23 // 8Mb
+)
+
+// rolling hash window size in bytes
+const windowSize = 48
+
+var buzTable [256]uint32
+
+func init() {
+  // table must be identical across runs/machines or chunk boundaries (and
+  // therefore dedup) would change - so use a fixed-seed LCG.
+  var x uint32 = 0x2545f491
+  for i := range buzTable {
+    x = x * 1664525 + 1013904223
+    buzTable[i] = x
+  }
+}
+
+// Chunker splits raw data into content blobs.
+//
+// Stream reads r until EOF and passes each chunk to fn as soon as it is
+// split off so that only about one chunk is held in memory at a time.
+// Streaming stops at the first error returned by fn.
+type Chunker interface {
+  Split(data []byte) []*Blob
+  Stream(r io.Reader, fn func(*Blob) error) error
+}
+
+// FixedChunker splits data into Size (bytes) chunks. A Size of zero or
+// less uses DefaultChunkSize.
+type FixedChunker struct {
+  Size int
+}
+
+func (c *FixedChunker) size() int {
+  if c.Size <= 0 {
+    return DefaultChunkSize
+  }
+  return c.Size
+}
+
+func (c *FixedChunker) Split(data []byte) []*Blob {
+  return SplitRaw(data, c.size())
+}
+
+func (c *FixedChunker) Stream(r io.Reader, fn func(*Blob) error) error {
+  size := c.size()
+  for {
+    data := make([]byte, size)
+    n, err := io.ReadFull(r, data)
+    if n > 0 {
+      if n < len(data) {
+        data = append([]byte{}, data[:n]...)
+      }
+      if err := fn(NewRaw(data)); err != nil {
+        return err
+      }
+    }
+
+    if err == io.EOF || err == io.ErrUnexpectedEOF {
+      return nil
+    } else if err != nil {
+      return err
+    }
+  }
+}
+
+// RollingChunker splits data at content-defined boundaries found with a
+// buzhash rolling hash. Inserting or removing bytes only changes the chunks
+// near the edit, so unchanged regions of a file produce identical blobs.
+//
+// Chunks are never smaller than Min (except the last) or larger than Max
+// bytes. A Max of zero or less uses DefaultMaxChunk. Avg is rounded up to
+// a power of two.
+type RollingChunker struct {
+  Min int
+  Avg int
+  Max int
+}
+
+// NewRollingChunker returns a content-defined chunker using the default
+// min/avg/max chunk sizes.
+func NewRollingChunker() *RollingChunker {
+  return &RollingChunker{
+    Min: DefaultMinChunk,
+    Avg: DefaultAvgChunk,
+    Max: DefaultMaxChunk,
+  }
+}
+
+func (c *RollingChunker) Split(data []byte) []*Blob {
+  blobs := make([]*Blob, 0)
+  for len(data) > 0 {
+    n := c.cut(data)
+    blobs = append(blobs, NewRaw(data[:n]))
+    data = data[n:]
+  }
+  return blobs
+}
+
+func (c *RollingChunker) Stream(r io.Reader, fn func(*Blob) error) error {
+  buf := make([]byte, 0, c.max())
+  eof := false
+  for {
+    if !eof {
+      n, err := io.ReadFull(r, buf[len(buf):cap(buf)])
+      buf = buf[:len(buf) + n]
+      if err == io.EOF || err == io.ErrUnexpectedEOF {
+        eof = true
+      } else if err != nil {
+        return err
+      }
+    }
+
+    if len(buf) == 0 {
+      return nil
+    }
+
+    n := c.cut(buf)
+    chunk := make([]byte, n)
+    copy(chunk, buf)
+    if err := fn(NewRaw(chunk)); err != nil {
+      return err
+    }
+    buf = buf[:copy(buf, buf[n:])]
+  }
+}
+
+// cut returns the length of the chunk at the start of data.
+func (c *RollingChunker) cut(data []byte) int {
+  if len(data) <= c.Min {
+    return len(data)
+  }
+
+  end := len(data)
+  if max := c.max(); max < end {
+    end = max
+  }
+
+  mask := c.mask()
+  start := c.Min - windowSize
+  if start < 0 {
+    start = 0
+  }
+
+  var h uint32
+  for i := start; i < end; i++ {
+    h = rotl(h, 1) ^ buzTable[data[i]]
+    if i - start >= windowSize {
+      h ^= rotl(buzTable[data[i - windowSize]], windowSize)
+    }
+    if i + 1 >= c.Min && h & mask == mask {
+      return i + 1
+    }
+  }
+  return end
+}
+
+// max returns the largest chunk size. Split and Stream must agree on it
+// or the same data would chunk differently depending on how it was read.
+func (c *RollingChunker) max() int {
+  if c.Max <= 0 {
+    return DefaultMaxChunk
+  }
+  return c.Max
+}
+
+func (c *RollingChunker) mask() uint32 {
+  var m uint32 = 1
+  for int(m) < c.Avg && m < 1 << 31 {
+    m <<= 1
+  }
+  return m - 1
+}
+
+func rotl(x uint32, n uint) uint32 {
+  n %= 32
+  return x << n | x >> (32 - n)
+}
@@ -0,0 +1,118 @@
+package blob
+
+import (
+  "bytes"
+  "testing"
+  "math/rand"
+)
+
+func randData(n int, seed int64) []byte {
+  data := make([]byte, n)
+  rand.New(rand.NewSource(seed)).Read(data)
+  return data
+}
+
+func chunkRefs(blobs []*Blob) map[string]bool {
+  refs := map[string]bool{}
+  for _, b := range blobs {
+    refs[b.Ref()] = true
+  }
+  return refs
+}
+
+func TestRollingChunkerSizes(t *testing.T) {
+  c := &RollingChunker{Min: 1 << 10, Avg: 4 << 10, Max: 16 << 10}
+  data := randData(1 << 20, 1)
+
+  blobs := c.Split(data)
+  for i, b := range blobs {
+    n := len(b.Content())
+    if n > c.Max || (n < c.Min && i < len(blobs) - 1) {
+      t.Errorf("chunk %v has %v bytes, want %v to %v", i, n, c.Min, c.Max)
+    }
+  }
+  if !bytes.Equal(Reconstitute(blobs...), data) {
+    t.Fatal("chunks don't reconstitute the data")
+  }
+}
+
+func TestRollingChunkerStable(t *testing.T) {
+  c := &RollingChunker{Min: 1 << 10, Avg: 4 << 10, Max: 16 << 10}
+  data := randData(1 << 20, 2)
+
+  // insert a few bytes in the middle
+  edited := append([]byte{}, data[:len(data) / 2]...)
+  edited = append(edited, "inserted"...)
+  edited = append(edited, data[len(data) / 2:]...)
+
+  before, after := c.Split(data), c.Split(edited)
+  refs := chunkRefs(before)
+  changed := 0
+  for _, b := range after {
+    if !refs[b.Ref()] {
+      changed++
+    }
+  }
+
+  // only the chunks around the edit may differ
+  if changed > 3 {
+    t.Errorf("%v of %v chunks changed after a small insert", changed, len(after))
+  }
+}
+
+func TestRollingChunkerStream(t *testing.T) {
+  c := &RollingChunker{Min: 1 << 10, Avg: 4 << 10, Max: 16 << 10}
+  checkStream(t, c, randData(300 << 10, 3))
+}
+
+func TestRollingChunkerZeroMax(t *testing.T) {
+  // an Avg this large (almost) never matches, so only the max cuts chunks
+  c := &RollingChunker{Min: 1 << 10, Avg: 1 << 30}
+  data := randData(DefaultMaxChunk * 2 + 10, 5)
+  checkStream(t, c, data)
+
+  if n := len(c.Split(data)); n != 3 {
+    t.Errorf("got %v chunks, want 3", n)
+  }
+}
+
+// checkStream fails if c streams data into different chunks than it
+// splits it into.
+func checkStream(t *testing.T, c Chunker, data []byte) {
+  streamed := []*Blob{}
+  err := c.Stream(bytes.NewReader(data), func(b *Blob) error {
+    streamed = append(streamed, b)
+    return nil
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  split := c.Split(data)
+  if len(streamed) != len(split) {
+    t.Fatalf("streamed %v chunks, split %v", len(streamed), len(split))
+  }
+  for i := range split {
+    if streamed[i].Ref() != split[i].Ref() {
+      t.Fatalf("chunk %v differs between Stream and Split", i)
+    }
+  }
+}
+
+func TestFixedChunkerZeroSize(t *testing.T) {
+  c := &FixedChunker{}
+  data := randData(DefaultChunkSize + 10, 4)
+
+  n := 0
+  err := c.Stream(bytes.NewReader(data), func(b *Blob) error {
+    n++
+    return nil
+  })
+  if err != nil {
+    t.Fatal(err)
+  } else if n != 2 {
+    t.Errorf("got %v chunks, want 2", n)
+  } else if len(c.Split(data)) != 2 {
+    t.Errorf("got %v split chunks, want 2", len(c.Split(data)))
+  }
+}
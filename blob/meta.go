@@ -5,8 +5,8 @@ import (
   "os"
   "errors"
   "encoding/json"
+  "io"
   "path/filepath"
-  "io/ioutil"
 )
 
 const (
@@ -20,6 +20,7 @@ type Meta struct {
   Notes map[string]string
   Size int64
   ContentRefs []string
+  Chunker Chunker `json:"-"` // nil splits into DefaultChunkSize chunks
 }
 
 // NewMeta creates a map containing meta-data for a file
@@ -34,33 +35,72 @@ func NewMeta() *Meta {
 
 // LoadFromPath fills in all meta fields (name, size, etc. by reading
 // the info from the file located at path. Blobs constituting the file's bytes
-// are returned. AddContentRefs is invoked for all the blobs returned.
+// are returned and split according to m's Chunker. AddContentRefs is invoked
+// for all the blobs returned.
+//
+// The returned blobs hold the entire file in memory - use StreamFromPath for
+// large files.
 func (m *Meta) LoadFromPath(path string) ([]*Blob, error) {
-  f, err := os.Open(path)
+  chunks := []*Blob{}
+  err := m.StreamFromPath(path, func(b *Blob) error {
+    chunks = append(chunks, b)
+    return nil
+  })
   if err != nil {
     return nil, err
   }
+  return chunks, nil
+}
 
-  data, err := ioutil.ReadAll(f)
+// StreamFromPath is the same as LoadFromPath except that blobs are passed
+// to fn one at a time as they are read from the file instead of being
+// returned.
+func (m *Meta) StreamFromPath(path string, fn func(*Blob) error) error {
+  f, err := os.Open(path)
   if err != nil {
-    return nil, err
+    return err
   }
+  defer f.Close()
 
-  chunks := SplitRaw(data, DefaultChunkSize)
-
-  // fill in meta fields
-  abs, _ := filepath.Abs(path)
-  abs = filepath.Dir(abs)
   stat, err := f.Stat()
   if err != nil {
-    return nil, err
+    return err
+  }
+
+  err = m.LoadFromReader(f, fn)
+  if err != nil {
+    return err
   }
 
   m.Name = stat.Name()
-  m.Size = stat.Size()
-  m.ContentRefs = RefsFor(chunks)
+  return nil
+}
 
-  return chunks, nil
+// LoadFromReader fills in m's Size and ContentRefs by splitting the bytes
+// read from r according to m's Chunker. Each chunk is passed to fn as soon as
+// it is split off.
+func (m *Meta) LoadFromReader(r io.Reader, fn func(*Blob) error) error {
+  var size int64
+  refs := []string{}
+  err := m.chunker().Stream(r, func(b *Blob) error {
+    size += int64(len(b.content))
+    refs = append(refs, b.Ref())
+    return fn(b)
+  })
+  if err != nil {
+    return err
+  }
+
+  m.Size = size
+  m.ContentRefs = refs
+  return nil
+}
+
+func (m *Meta) chunker() Chunker {
+  if m.Chunker == nil {
+    return &FixedChunker{Size: DefaultChunkSize}
+  }
+  return m.Chunker
 }
 
 // AddNotes allows arbitrary meta-data to be attached to any file.
@@ -113,6 +153,16 @@ func Reconstitute(blobs ...*Blob) []byte {
 
 func DirBlobsAndMeta(path string) (metas []*Meta, blobs []*Blob, err error) {
   blobs = make([]*Blob, 0)
+  metas, err = DirStream(path, func(b *Blob) error {
+    blobs = append(blobs, b)
+    return nil
+  })
+  return metas, blobs, err
+}
+
+// DirStream creates a Meta for every file under path. Content blobs are
+// passed to fn as they are read instead of being accumulated in memory.
+func DirStream(path string, fn func(*Blob) error) (metas []*Meta, err error) {
   metas = make([]*Meta, 0)
 
   walkFn := func(path string, info os.FileInfo, inerr error) error {
@@ -121,18 +171,17 @@ func DirBlobsAndMeta(path string) (metas []*Meta, blobs []*Blob, err error) {
     }
 
     meta := NewMeta()
-    newblobs, err := meta.LoadFromPath(path)
+    err := meta.StreamFromPath(path, fn)
     if err != nil {
       return err
     }
 
-    blobs = append(blobs, newblobs...)
     metas = append(metas, meta)
     return nil
   }
 
   err = filepath.Walk(path, walkFn)
-  return metas, blobs, err
+  return metas, err
 }
 
 func min(vals ...int) int {
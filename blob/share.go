@@ -1,12 +1,58 @@
 
 package blob
 
+import (
+  "path"
+  "time"
+  "errors"
+  "strings"
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/subtle"
+  "crypto/pbkdf2"
+  "encoding/hex"
+)
+
+const (
+  RevocationType = "share-revocation" // revokes a share blob
+  ShareVersion = 2
+  // MountNotesKey is the Meta notes key holding a file's mount info (a
+  // json object with a Path field).
+  MountNotesKey = "mount"
+  // PassIter is the number of pbkdf2 rounds used to hash new share
+  // passwords.
+  PassIter = 600000
+)
+
+var BadPrefixErr = errors.New("blob: share path prefixes must be below the root")
+
+// Share grants access to blobs to whoever presents it (see Grantee).
+// Version 1 shares (Version is 0) only have TargetRefs and Auth.
 type Share struct {
   RcasType string
+  Version int
   TargetRefs []string
   Auth *Authorization
+  // PathPrefixes grants gets of every file meta whose mount Path is equal
+  // to or under one of the prefixes. Paths are compared by whole
+  // components and empty or root prefixes are not allowed (see Validate).
+  PathPrefixes []string
+  // Grantee restricts use of the share to the user name or key id that
+  // authenticated the request. Empty allows anyone. Grant shares to users
+  // with the guest role; other users can retrieve everything anyway.
+  Grantee string
+  Expires time.Time // zero value never expires
+  MaxUses int // max number of authorized gets/puts; 0 is unlimited
+  PassSalt string
+  PassHash string // empty if no password is required
+  // PassIter is the number of pbkdf2 rounds PassHash was made with. Zero
+  // means a single salted sha256 (shares made before pbkdf2 was used).
+  PassIter int
 }
 
+// Authorization describes how TargetRefs are shared. Gets of any authorized
+// file meta also grant gets of the meta's content blobs (see
+// AuthorizedContent).
 type Authorization struct {
   StaticGet bool // only access refs explicitly listed in TargetRefs
   DynamicGet bool// access any ref that is part of shared object ref
@@ -18,21 +64,154 @@ type Authorization struct {
 func NewShare() *Share {
   return &Share{
     RcasType: ShareType,
+    Version: ShareVersion,
     Auth: &Authorization{},
   }
 }
 
+// SetPassword requires pass to be presented with any use of the share. Only
+// a salted pbkdf2 hash of pass is stored in the share.
+func (sh *Share) SetPassword(pass string) {
+  salt := make([]byte, 16)
+  if _, err := rand.Read(salt); err != nil {
+    panic(err)
+  }
+  sh.PassSalt = hex.EncodeToString(salt)
+  sh.PassIter = PassIter
+  sh.PassHash = sh.hashPass(pass)
+}
+
+// CheckPassword returns true if pass matches the share's password or if the
+// share has no password.
+func (sh *Share) CheckPassword(pass string) bool {
+  if sh.PassHash == "" {
+    return true
+  }
+  return subtle.ConstantTimeCompare([]byte(sh.hashPass(pass)), []byte(sh.PassHash)) == 1
+}
+
+func (sh *Share) hashPass(pass string) string {
+  if sh.PassIter == 0 {
+    sum := sha256.Sum256([]byte(sh.PassSalt + pass))
+    return hex.EncodeToString(sum[:])
+  }
+
+  salt, err := hex.DecodeString(sh.PassSalt)
+  if err != nil {
+    return ""
+  }
+  key, err := pbkdf2.Key(sha256.New, pass, salt, sh.PassIter, sha256.Size)
+  if err != nil {
+    return ""
+  }
+  return hex.EncodeToString(key)
+}
+
+// Validate returns BadPrefixErr if any of the share's PathPrefixes is
+// empty or the root, which would grant every file meta.
+func (sh *Share) Validate() error {
+  for _, prefix := range sh.PathPrefixes {
+    if cleanPrefix(prefix) == "" {
+      return BadPrefixErr
+    }
+  }
+  return nil
+}
+
+// cleanPrefix returns prefix cleaned of redundant separators and dot
+// elements or "" if it is empty or the root.
+func cleanPrefix(prefix string) string {
+  prefix = path.Clean(prefix)
+  if prefix == "." || prefix == "/" {
+    return ""
+  }
+  return prefix
+}
+
+// Expired returns true if the share is no longer valid at time t.
+func (sh *Share) Expired(t time.Time) bool {
+  return !sh.Expires.IsZero() && t.After(sh.Expires)
+}
+
+// Revocation permanently invalidates the share blob ShareRef.
+type Revocation struct {
+  RcasType string
+  ShareRef string
+}
+
+func NewRevocation(shareRef string) *Revocation {
+  return &Revocation{
+    RcasType: RevocationType,
+    ShareRef: shareRef,
+  }
+}
+
+// AuthorizedFor returns true if the share may be used by the user or key
+// id (empty for anonymous requests).
+func (sh *Share) AuthorizedFor(id string) bool {
+  return sh.Grantee == "" || sh.Grantee == id
+}
+
 // AuthorizedGet returns true if this share allows retrieval of b
 func (sh *Share) AuthorizedGet(b *Blob) bool {
-  good := false
+  return sh.AuthorizedTarget(b) || sh.underPrefix(b)
+}
 
+// AuthorizedTarget returns true if b is granted by the share's TargetRefs
+// alone. Unlike PathPrefixes grants, this doesn't depend on anything the
+// blob says about itself other than its object ref.
+func (sh *Share) AuthorizedTarget(b *Blob) bool {
   if sh.Auth.StaticGet {
-    good = sh.have(b.Ref())
+    return sh.have(b.Ref())
   } else if sh.Auth.DynamicGet {
-    good = sh.have(b.ObjectRef())
+    return sh.have(b.ObjectRef()) || sh.have(b.Ref())
+  }
+  return false
+}
+
+// AuthorizedContent returns true if this share allows retrieval of b as
+// part of the content of the file meta blob meta.
+func (sh *Share) AuthorizedContent(meta, b *Blob) bool {
+  if meta.Type() != MetaType || !sh.AuthorizedGet(meta) {
+    return false
+  }
+
+  m := &Meta{}
+  if err := Unmarshal(meta, m); err != nil {
+    return false
+  }
+  for _, ref := range m.ContentRefs {
+    if ref == b.Ref() {
+      return true
+    }
   }
+  return false
+}
 
-  return good
+func (sh *Share) underPrefix(b *Blob) bool {
+  if len(sh.PathPrefixes) == 0 || b.Type() != MetaType {
+    return false
+  }
+
+  m := &Meta{}
+  if err := Unmarshal(b, m); err != nil {
+    return false
+  }
+  mm := &struct{ Path string }{}
+  if err := m.GetNotes(MountNotesKey, mm); err != nil {
+    return false
+  }
+
+  p := path.Clean(mm.Path)
+  for _, prefix := range sh.PathPrefixes {
+    prefix = cleanPrefix(prefix)
+    if prefix == "" {
+      continue
+    } else if p == prefix || strings.HasPrefix(p, prefix + "/") {
+      return true
+    }
+  }
+  return false
 }
 
 // AuthorizedPut returns true if this share allows attaching new versions
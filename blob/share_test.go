@@ -0,0 +1,74 @@
+package blob
+
+import (
+  "testing"
+)
+
+// mounted returns a file meta blob mounted at pth.
+func mounted(t *testing.T, pth string) *Blob {
+  m := NewMeta()
+  m.ContentRefs = []string{NewRaw([]byte(pth)).Ref()}
+  if err := m.SetNotes(MountNotesKey, &struct{ Path string }{pth}); err != nil {
+    t.Fatal(err)
+  }
+  b, err := Marshal(m)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return b
+}
+
+func TestSharePrefixes(t *testing.T) {
+  sh := NewShare()
+  sh.PathPrefixes = []string{"photos/2012/", "./docs//work"}
+  if err := sh.Validate(); err != nil {
+    t.Fatal(err)
+  }
+
+  tests := []struct {
+    pth string
+    want bool
+  }{
+    {"photos/2012", true},
+    {"photos/2012/a.jpg", true},
+    {"photos/2012/trip/b.jpg", true},
+    {"photos/2012-old/a.jpg", false},
+    {"photos/2013/a.jpg", false},
+    {"photos", false},
+    {"docs/work/plan.txt", true},
+    {"docs/workshop/plan.txt", false},
+    {"photos/2012/../secret.txt", false},
+  }
+
+  for _, test := range tests {
+    b := mounted(t, test.pth)
+    if got := sh.AuthorizedGet(b); got != test.want {
+      t.Errorf("get of %v: got %v, want %v", test.pth, got, test.want)
+    }
+    content := NewRaw([]byte(test.pth))
+    if got := sh.AuthorizedContent(b, content); got != test.want {
+      t.Errorf("content of %v: got %v, want %v", test.pth, got, test.want)
+    }
+  }
+
+  // prefixes don't grant anything but file metas
+  if sh.AuthorizedGet(NewRaw([]byte("photos/2012/a.jpg"))) {
+    t.Errorf("prefix granted a non-meta blob")
+  }
+  if sh.AuthorizedContent(mounted(t, "photos/2012/a.jpg"), NewRaw([]byte("other"))) {
+    t.Errorf("prefix granted a blob that isn't the meta's content")
+  }
+}
+
+func TestShareRootPrefix(t *testing.T) {
+  for _, prefix := range []string{"", ".", "/", "//", "a/.."} {
+    sh := NewShare()
+    sh.PathPrefixes = []string{"photos", prefix}
+    if err := sh.Validate(); err != BadPrefixErr {
+      t.Errorf("prefix %q: got err %v, want %v", prefix, err, BadPrefixErr)
+    }
+    if sh.AuthorizedGet(mounted(t, "docs/a.txt")) {
+      t.Errorf("prefix %q granted a file outside the other prefixes", prefix)
+    }
+  }
+}
@@ -1,82 +1,209 @@
-
 package blobdb
 
 import (
-  "fmt"
-  "path"
-  "io/ioutil"
-  "errors"
-  "strings"
   "os"
-  "encoding/hex"
-  "crypto"
+  "sort"
+  "errors"
+  "io/ioutil"
   "path/filepath"
+  "time"
+  "encoding/hex"
   "github.com/rwcarlsen/cas/blob"
 )
 
 var (
   DupContentErr = errors.New("blobdb: blob hash-content combo already exist")
   HashCollideErr = errors.New("blobdb: blob hash collision")
+  NotFoundErr = errors.New("blobdb: blob not found")
+  UnknownStorageErr = errors.New("blobdb: unknown storage kind")
+  LockedErr = errors.New("blobdb: database is in use by another process")
+)
+
+const (
+  quarantineDir = ".quarantine"
+  lockName = ".lock"
+)
+
+// CorruptBlobError is returned by Get when a stored blob's content does not
+// hash to its ref.
+type CorruptBlobError struct {
+  Ref string
+}
+
+func (e *CorruptBlobError) Error() string {
+  return "blobdb: content of blob " + e.Ref + " does not match its hash"
+}
+
+// storage kinds accepted by Open
+const (
+  DirStorage = "dir"
+  PackStorage = "pack"
+  MemStorage = "mem"
 )
 
+// Storage is implemented by backends that hold raw blob bytes.
+//
+// Implementations need not verify blob content - Dbase takes care of
+// integrity checks and duplicate detection.
+type Storage interface {
+  // Get returns the blob stored under ref or NotFoundErr.
+  Get(ref string) (*blob.Blob, error)
+  // Put stores b under b.Ref(), replacing any existing blob with that ref.
+  Put(b *blob.Blob) error
+  Has(ref string) bool
+  // Stat returns the size in bytes of the blob stored under ref or
+  // NotFoundErr.
+  Stat(ref string) (size int64, err error)
+  // ModTime returns the time the blob stored under ref was last written or
+  // NotFoundErr.
+  ModTime(ref string) (time.Time, error)
+  // Enumerate sends every stored ref in sorted order through the returned
+  // channel. Runs in a self-dispatched goroutine.
+  Enumerate() chan string
+  // List returns up to max stored refs in sorted order that sort after
+  // the ref after without visiting the refs before it where possible.
+  List(after string, max int) []string
+  Remove(ref string) error
+}
+
 type Dbase struct {
-  location string
+  store Storage
+  // Quarantine is the directory corrupted blobs are moved into when
+  // detected by Get. Empty leaves corrupted blobs in place.
+  Quarantine string
 }
 
+// New returns a Dbase backed by a directory store at loc.
 func New(loc string) (db *Dbase, err error) {
-  var mode os.FileMode = 0744
-  if os.MkdirAll(loc, mode); err != nil {
+  s, err := NewDirStore(loc)
+  if err != nil {
     return nil, err
   }
-  return &Dbase{location: loc}, nil
+  db = NewWith(s)
+  db.Quarantine = filepath.Join(loc, quarantineDir)
+  return db, nil
+}
+
+// NewWith returns a Dbase backed by the given storage.
+func NewWith(s Storage) *Dbase {
+  return &Dbase{store: s}
 }
 
-func blobRefParts(ref string) (hash crypto.Hash, sum string) {
-  parts := strings.Split(ref, blob.NameHashSep)
-  if len(parts) != 2 {
-    panic("blobdb: Invalref blob ref " + ref)
+// Open returns a Dbase backed by a storage of the given kind (DirStorage,
+// PackStorage or MemStorage) located at loc.
+func Open(kind, loc string) (*Dbase, error) {
+  var s Storage
+  var err error
+  switch kind {
+    case DirStorage, "":
+      s, err = NewDirStore(loc)
+    case PackStorage:
+      s, err = NewPackStore(loc)
+    case MemStorage:
+      s = NewMemStore()
+    default:
+      return nil, UnknownStorageErr
   }
 
-  return blob.NameToHash(parts[0]), parts[1]
+  if err != nil {
+    return nil, err
+  }
+
+  db := NewWith(s)
+  if kind != MemStorage {
+    db.Quarantine = filepath.Join(loc, quarantineDir)
+  }
+  return db, nil
 }
 
-func (db *Dbase) Get(ref string) (b *blob.Blob, err error) {
-  defer func() {
-    if r := recover(); r != nil {
-      err = errors.New(fmt.Sprint(r))
-    }
-  }()
+// Storage returns the backend holding the Dbase's blobs.
+func (db *Dbase) Storage() Storage {
+  return db.store
+}
 
-  p := path.Join(db.location, ref)
-  f, err := os.Open(p)
+// newBlob creates a blob for data using the hash named in ref.
+func newBlob(ref string, data []byte) *blob.Blob {
+  hash, _, err := blob.ParseRef(ref)
   if err != nil {
-    return
+    hash = blob.DefaultHash
   }
-  defer f.Close()
+  b := blob.NewRaw(data)
+  b.Hash = hash
+  return b
+}
 
-  data, err := ioutil.ReadAll(f)
+// Get retrieves the blob stored under ref. If its content doesn't hash to
+// ref a *CorruptBlobError is returned and the blob is quarantined.
+func (db *Dbase) Get(ref string) (b *blob.Blob, err error) {
+  b, err = db.Verify(ref)
+  if _, ok := err.(*CorruptBlobError); ok {
+    db.quarantine(ref, b)
+  }
   if err != nil {
-    return
+    return nil, err
   }
+  return b, nil
+}
 
-  hash, sum := blobRefParts(ref)
-  b = blob.NewRaw(data)
-  b.Hash = hash
+// Verify retrieves the blob stored under ref like Get but leaves it in
+// place if it is corrupt. The corrupt blob is returned along with a
+// *CorruptBlobError.
+func (db *Dbase) Verify(ref string) (b *blob.Blob, err error) {
+  _, sum, err := blob.ParseRef(ref)
+  if err != nil {
+    return nil, err
+  }
 
-  err = verifyBlob(sum, b)
+  b, err = db.store.Get(ref)
+  if err != nil {
+    return nil, err
+  }
+
+  if err := verifyBlob(sum, b); err != nil {
+    return b, &CorruptBlobError{Ref: ref}
+  }
   return b, nil
 }
 
+// QuarantineBlob moves the corrupt blob stored under ref out of the store
+// (into the quarantine directory if there is one) so a good copy can be
+// put in its place. Blobs that aren't corrupt are left alone.
+func (db *Dbase) QuarantineBlob(ref string) error {
+  b, err := db.Verify(ref)
+  if _, ok := err.(*CorruptBlobError); !ok {
+    return err
+  } else if db.Quarantine == "" {
+    return db.store.Remove(ref)
+  }
+  return db.quarantine(ref, b)
+}
+
+// quarantine moves a corrupted blob out of the store into the quarantine
+// directory for later inspection.
+func (db *Dbase) quarantine(ref string, b *blob.Blob) error {
+  if db.Quarantine == "" {
+    return nil
+  }
+
+  if err := os.MkdirAll(db.Quarantine, 0744); err != nil {
+    return err
+  }
+  pth := filepath.Join(db.Quarantine, filepath.Base(ref))
+  if err := ioutil.WriteFile(pth, b.Content(), 0644); err != nil {
+    return err
+  }
+  return db.store.Remove(ref)
+}
+
 func (db *Dbase) Put(blobs ...*blob.Blob) (err error) {
   // separate loop for error checking makes Puts all or nothing
   var dup error = nil
+  stored := map[string]bool{}
   for _, b := range blobs {
-    ref := b.Ref()
-    p := path.Join(db.location, ref)
-
-    if info, err := os.Stat(p); err == nil {
-      if info.Size() == int64(len(b.Content())) {
+    if size, err := db.store.Stat(b.Ref()); err == nil {
+      if size == int64(len(b.Content())) {
         dup = DupContentErr
+        stored[b.Ref()] = true
       } else {
         return HashCollideErr
       }
@@ -84,7 +211,11 @@ func (db *Dbase) Put(blobs ...*blob.Blob) (err error) {
   }
 
   for _, b := range blobs {
-    err = db.writeBlob(b)
+    if stored[b.Ref()] {
+      // already there - don't rewrite it
+      continue
+    }
+    err = db.store.Put(b)
     if err != nil {
       return err
     }
@@ -92,42 +223,59 @@ func (db *Dbase) Put(blobs ...*blob.Blob) (err error) {
   return dup
 }
 
-// Walk traverses the Dbase and returns each blob through the passed 
+func (db *Dbase) Has(ref string) bool {
+  return db.store.Has(ref)
+}
+
+func (db *Dbase) Stat(ref string) (size int64, err error) {
+  return db.store.Stat(ref)
+}
+
+func (db *Dbase) ModTime(ref string) (time.Time, error) {
+  return db.store.ModTime(ref)
+}
+
+func (db *Dbase) Remove(ref string) error {
+  return db.store.Remove(ref)
+}
+
+// Enumerate returns every ref in the Dbase through the passed channel in
+// sorted order. Runs in a self-dispatched goroutine.
+func (db *Dbase) Enumerate() chan string {
+  return db.store.Enumerate()
+}
+
+// List returns up to max refs (in sorted order) that sort after the ref
+// after. An empty after starts from the first ref.
+func (db *Dbase) List(after string, max int) []string {
+  return db.store.List(after, max)
+}
+
+// Walk traverses the Dbase and returns each blob through the passed
 // channel. Runs in a self-dispatched goroutine
 func (db *Dbase) Walk() chan *blob.Blob {
   ch := make(chan *blob.Blob)
-  fn := func(path string, info os.FileInfo, inerr error) error {
-    if info.IsDir() {
-      return nil
-    }
-
-    b, err := db.Get(info.Name())
-    if err != nil {
-      return nil
-    }
-    ch <- b
-    return nil
-  }
-
   go func() {
-    filepath.Walk(db.location, fn)
+    for ref := range db.store.Enumerate() {
+      b, err := db.Get(ref)
+      if err != nil {
+        continue
+      }
+      ch <- b
+    }
     close(ch)
   }()
 
   return ch
 }
 
-func (db *Dbase) writeBlob(b *blob.Blob) (err error) {
-  ref := b.Ref()
-  p := path.Join(db.location, ref)
-  f, err := os.Create(p)
-  if err != nil {
-    return err
+// firstRefs sorts refs and returns at most the first max of them.
+func firstRefs(refs []string, max int) []string {
+  sort.Strings(refs)
+  if len(refs) > max {
+    refs = refs[:max]
   }
-  defer f.Close()
-
-  _, err = f.Write(b.Content())
-  return err
+  return refs
 }
 
 func verifyBlob(sum string, b *blob.Blob) (err error) {
@@ -136,4 +284,3 @@ func verifyBlob(sum string, b *blob.Blob) (err error) {
   }
   return
 }
-
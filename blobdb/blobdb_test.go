@@ -0,0 +1,112 @@
+package blobdb
+
+import (
+  "os"
+  "fmt"
+  "sort"
+  "testing"
+  "io/ioutil"
+  "path/filepath"
+  "github.com/rwcarlsen/cas/blob"
+)
+
+// listAll pages through s max refs at a time.
+func listAll(s Storage, max int) []string {
+  all := []string{}
+  after := ""
+  for {
+    refs := s.List(after, max)
+    if len(refs) == 0 {
+      return all
+    }
+    all = append(all, refs...)
+    after = refs[len(refs) - 1]
+  }
+}
+
+func TestList(t *testing.T) {
+  dir, err := ioutil.TempDir("", "blobdb")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  ds, err := NewDirStore(filepath.Join(dir, "dir"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  ps, err := NewPackStore(filepath.Join(dir, "pack"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer ps.Close()
+  stores := map[string]Storage{"dir": ds, "pack": ps, "mem": NewMemStore()}
+
+  want := []string{}
+  for i := 0; i < 200; i++ {
+    b := blob.NewRaw([]byte(fmt.Sprint("list blob ", i)))
+    want = append(want, b.Ref())
+    for _, s := range stores {
+      if err := s.Put(b); err != nil {
+        t.Fatal(err)
+      }
+    }
+
+    // some blobs of the dir store are in the older flat layout
+    if i % 7 == 0 {
+      ds.Remove(b.Ref())
+      ioutil.WriteFile(ds.flatPath(b.Ref()), b.Content(), 0644)
+    }
+  }
+  sort.Strings(want)
+
+  for name, s := range stores {
+    for _, max := range []int{1, 13, 200, 1000} {
+      got := listAll(s, max)
+      if fmt.Sprint(got) != fmt.Sprint(want) {
+        t.Errorf("%v store paged by %v: got %v refs, want %v in order", name, max, len(got), len(want))
+      }
+    }
+
+    // a cursor between refs starts at the next one
+    cursor := want[50][:len(want[50]) - 1]
+    if refs := s.List(cursor, 1); len(refs) != 1 || refs[0] != want[50] {
+      t.Errorf("%v store: list after %v = %v, want %v", name, cursor, refs, want[50])
+    }
+  }
+}
+
+func TestDirStoreBadRefs(t *testing.T) {
+  dir, err := ioutil.TempDir("", "blobdb")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  s, err := NewDirStore(filepath.Join(dir, "db"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  outside := filepath.Join(dir, "outside")
+  if err := ioutil.WriteFile(outside, []byte("not a blob"), 0644); err != nil {
+    t.Fatal(err)
+  }
+
+  for _, ref := range []string{"x-abcd/../../../outside", "../outside", "outside", "sha256-xyz"} {
+    if s.Has(ref) {
+      t.Errorf("Has(%q) is true", ref)
+    }
+    if _, err := s.Stat(ref); err != blob.InvalidRefErr {
+      t.Errorf("Stat(%q): got err %v, want %v", ref, err, blob.InvalidRefErr)
+    }
+    if _, err := s.Get(ref); err != blob.InvalidRefErr {
+      t.Errorf("Get(%q): got err %v, want %v", ref, err, blob.InvalidRefErr)
+    }
+    if err := s.Remove(ref); err != blob.InvalidRefErr {
+      t.Errorf("Remove(%q): got err %v, want %v", ref, err, blob.InvalidRefErr)
+    }
+  }
+  if _, err := os.Stat(outside); err != nil {
+    t.Errorf("file outside the store is gone: %v", err)
+  }
+}
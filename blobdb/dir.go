@@ -0,0 +1,325 @@
+package blobdb
+
+import (
+  "os"
+  "sort"
+  "strings"
+  "time"
+  "io/ioutil"
+  "path/filepath"
+  "github.com/rwcarlsen/cas/blob"
+)
+
+const tmpDir = ".tmp"
+
+// DirStore keeps each blob in its own file named by its ref. Files are
+// sharded by hash name and sum prefix (e.g. sha256/ab/cd/sha256-abcd...) so
+// no single directory grows too large.
+//
+// Blobs stored in the older flat layout (directly inside the store's
+// location) are still readable and can be moved into the sharded layout
+// with Migrate.
+type DirStore struct {
+  location string
+}
+
+func NewDirStore(loc string) (*DirStore, error) {
+  var mode os.FileMode = 0744
+  if err := os.MkdirAll(filepath.Join(loc, tmpDir), mode); err != nil {
+    return nil, err
+  }
+  return &DirStore{location: loc}, nil
+}
+
+// shardPath returns the sharded location for ref.
+func (s *DirStore) shardPath(ref string) string {
+  parts := strings.SplitN(ref, blob.NameHashSep, 2)
+  if len(parts) != 2 || len(parts[1]) < 4 {
+    return s.flatPath(ref)
+  }
+  sum := parts[1]
+  return filepath.Join(s.location, parts[0], sum[0:2], sum[2:4], ref)
+}
+
+func (s *DirStore) flatPath(ref string) string {
+  return filepath.Join(s.location, filepath.Base(ref))
+}
+
+// find returns the path of the file holding ref in either layout. Refs
+// are validated first since they are joined into file paths.
+func (s *DirStore) find(ref string) (pth string, info os.FileInfo, err error) {
+  if _, _, err := blob.ParseRef(ref); err != nil {
+    return "", nil, err
+  }
+
+  for _, pth := range []string{s.shardPath(ref), s.flatPath(ref)} {
+    info, err = os.Stat(pth)
+    if err == nil && !info.IsDir() {
+      return pth, info, nil
+    } else if err != nil && !os.IsNotExist(err) {
+      return "", nil, err
+    }
+  }
+  return "", nil, NotFoundErr
+}
+
+func (s *DirStore) Get(ref string) (*blob.Blob, error) {
+  pth, _, err := s.find(ref)
+  if err != nil {
+    return nil, err
+  }
+
+  data, err := ioutil.ReadFile(pth)
+  if err != nil {
+    return nil, err
+  }
+  return newBlob(ref, data), nil
+}
+
+// Put writes b to a temporary file which is synced to disk before being
+// renamed into place. A crash mid-write never leaves a partial blob under a
+// valid ref.
+func (s *DirStore) Put(b *blob.Blob) error {
+  return s.writeFile(b.Ref(), b.Content())
+}
+
+func (s *DirStore) writeFile(ref string, data []byte) error {
+  f, err := ioutil.TempFile(filepath.Join(s.location, tmpDir), "put-")
+  if err != nil {
+    return err
+  }
+  tmp := f.Name()
+
+  _, err = f.Write(data)
+  if err == nil {
+    err = f.Sync()
+  }
+  if cerr := f.Close(); err == nil {
+    err = cerr
+  }
+  if err != nil {
+    os.Remove(tmp)
+    return err
+  }
+
+  dst := s.shardPath(ref)
+  if err := os.MkdirAll(filepath.Dir(dst), 0744); err != nil {
+    os.Remove(tmp)
+    return err
+  }
+  if err := os.Rename(tmp, dst); err != nil {
+    os.Remove(tmp)
+    return err
+  }
+  return syncDir(filepath.Dir(dst))
+}
+
+// syncDir flushes directory entries (e.g. a rename) to disk.
+func syncDir(dir string) error {
+  d, err := os.Open(dir)
+  if err != nil {
+    return err
+  }
+  defer d.Close()
+  d.Sync()
+  return nil
+}
+
+func (s *DirStore) Has(ref string) bool {
+  _, err := s.Stat(ref)
+  return err == nil
+}
+
+func (s *DirStore) Stat(ref string) (size int64, err error) {
+  _, info, err := s.find(ref)
+  if err != nil {
+    return 0, err
+  }
+  return info.Size(), nil
+}
+
+func (s *DirStore) ModTime(ref string) (time.Time, error) {
+  _, info, err := s.find(ref)
+  if err != nil {
+    return time.Time{}, err
+  }
+  return info.ModTime(), nil
+}
+
+// Enumerate merges refs from the sharded and flat layouts into a single
+// sorted stream.
+func (s *DirStore) Enumerate() chan string {
+  ch := make(chan string)
+  go func() {
+    defer close(ch)
+
+    flat := s.flatRefs()
+    fn := func(pth string, info os.FileInfo, inerr error) error {
+      if inerr != nil {
+        return nil
+      }
+      if info.IsDir() {
+        // skip temp, quarantine, etc. directories
+        if pth != s.location && strings.HasPrefix(info.Name(), ".") {
+          return filepath.SkipDir
+        }
+        return nil
+      }
+      if filepath.Dir(pth) == filepath.Clean(s.location) || !isRef(info.Name()) {
+        return nil
+      }
+
+      ref := info.Name()
+      for len(flat) > 0 && flat[0] <= ref {
+        if flat[0] != ref {
+          ch <- flat[0]
+        }
+        flat = flat[1:]
+      }
+      ch <- ref
+      return nil
+    }
+    filepath.Walk(s.location, fn)
+
+    for _, ref := range flat {
+      ch <- ref
+    }
+  }()
+
+  return ch
+}
+
+// List reads only the shard directories that can hold refs after the ref
+// after (merging in refs from the flat layout) and stops once max refs are
+// found.
+func (s *DirStore) List(after string, max int) []string {
+  flat := []string{}
+  for _, ref := range s.flatRefs() {
+    if ref > after {
+      flat = append(flat, ref)
+    }
+  }
+
+  refs := []string{}
+  add := func(ref string) bool {
+    for len(flat) > 0 && flat[0] <= ref && len(refs) < max {
+      if flat[0] != ref {
+        refs = append(refs, flat[0])
+      }
+      flat = flat[1:]
+    }
+    if len(refs) < max {
+      refs = append(refs, ref)
+    }
+    return len(refs) < max
+  }
+  s.listShards(s.location, "", 0, after, add)
+
+  for _, ref := range flat {
+    if len(refs) == max {
+      break
+    }
+    refs = append(refs, ref)
+  }
+  return refs
+}
+
+// listShards passes the refs after the ref after found under the shard
+// directory dir (depth levels below the store's location) to add in sorted
+// order. Every ref under dir starts with prefix. It returns false once add
+// does.
+func (s *DirStore) listShards(dir, prefix string, depth int, after string, add func(string) bool) bool {
+  infos, err := ioutil.ReadDir(dir)
+  if err != nil {
+    return true
+  }
+
+  for _, info := range infos {
+    name := info.Name()
+    if depth == 3 {
+      if !info.IsDir() && isRef(name) && name > after && !add(name) {
+        return false
+      }
+      continue
+    } else if !info.IsDir() || strings.HasPrefix(name, ".") {
+      continue
+    }
+
+    p := prefix + name
+    if depth == 0 {
+      p += blob.NameHashSep
+    }
+    cut := after
+    if len(cut) > len(p) {
+      cut = cut[:len(p)]
+    }
+    if p < cut {
+      // every ref in the directory sorts before after
+      continue
+    }
+    if !s.listShards(filepath.Join(dir, name), p, depth + 1, after, add) {
+      return false
+    }
+  }
+  return true
+}
+
+// flatRefs returns the sorted refs of blobs stored in the flat layout.
+func (s *DirStore) flatRefs() []string {
+  infos, err := ioutil.ReadDir(s.location)
+  if err != nil {
+    return nil
+  }
+
+  refs := []string{}
+  for _, info := range infos {
+    if !info.IsDir() && isRef(info.Name()) {
+      refs = append(refs, info.Name())
+    }
+  }
+  sort.Strings(refs)
+  return refs
+}
+
+func (s *DirStore) Remove(ref string) error {
+  if _, _, err := blob.ParseRef(ref); err != nil {
+    return err
+  }
+
+  found := false
+  for _, pth := range []string{s.shardPath(ref), s.flatPath(ref)} {
+    err := os.Remove(pth)
+    if err == nil {
+      found = true
+    } else if !os.IsNotExist(err) {
+      return err
+    }
+  }
+
+  if !found {
+    return NotFoundErr
+  }
+  return nil
+}
+
+// Migrate moves every blob stored in the flat layout into the sharded
+// layout. It is safe to interrupt and rerun.
+func (s *DirStore) Migrate() (n int, err error) {
+  for _, ref := range s.flatRefs() {
+    dst := s.shardPath(ref)
+    if err := os.MkdirAll(filepath.Dir(dst), 0744); err != nil {
+      return n, err
+    }
+    if err := os.Rename(s.flatPath(ref), dst); err != nil {
+      return n, err
+    }
+    n++
+  }
+  return n, nil
+}
+
+// isRef returns true if name has the form of a blob ref for a known hash.
+func isRef(name string) bool {
+  _, _, err := blob.ParseRef(name)
+  return err == nil
+}
@@ -0,0 +1,31 @@
+// +build !windows
+
+package blobdb
+
+import (
+  "os"
+  "syscall"
+  "path/filepath"
+)
+
+// Lock takes an exclusive lock on the database at loc that is held until
+// the returned file is closed or the process exits. LockedErr is returned
+// if another process (e.g. a running server) holds it.
+func Lock(loc string) (*os.File, error) {
+  if err := os.MkdirAll(loc, 0744); err != nil {
+    return nil, err
+  }
+  f, err := os.OpenFile(filepath.Join(loc, lockName), os.O_RDWR | os.O_CREATE, 0644)
+  if err != nil {
+    return nil, err
+  }
+
+  if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX | syscall.LOCK_NB); err != nil {
+    f.Close()
+    if err == syscall.EWOULDBLOCK {
+      return nil, LockedErr
+    }
+    return nil, err
+  }
+  return f, nil
+}
@@ -0,0 +1,15 @@
+package blobdb
+
+import (
+  "os"
+  "path/filepath"
+)
+
+// Lock opens the database's lock file. Locking isn't supported on
+// windows, so LockedErr is never returned.
+func Lock(loc string) (*os.File, error) {
+  if err := os.MkdirAll(loc, 0744); err != nil {
+    return nil, err
+  }
+  return os.OpenFile(filepath.Join(loc, lockName), os.O_RDWR | os.O_CREATE, 0644)
+}
@@ -0,0 +1,115 @@
+package blobdb
+
+import (
+  "sort"
+  "sync"
+  "time"
+  "github.com/rwcarlsen/cas/blob"
+)
+
+// MemStore is a thread-safe, non-persistent store useful for testing.
+type MemStore struct {
+  blobs map[string][]byte
+  times map[string]time.Time
+  lock sync.RWMutex
+}
+
+func NewMemStore() *MemStore {
+  return &MemStore{
+    blobs: map[string][]byte{},
+    times: map[string]time.Time{},
+  }
+}
+
+func (s *MemStore) Get(ref string) (*blob.Blob, error) {
+  s.lock.RLock()
+  defer s.lock.RUnlock()
+
+  data, ok := s.blobs[ref]
+  if !ok {
+    return nil, NotFoundErr
+  }
+  return newBlob(ref, data), nil
+}
+
+func (s *MemStore) Put(b *blob.Blob) error {
+  s.lock.Lock()
+  defer s.lock.Unlock()
+
+  s.blobs[b.Ref()] = b.Content()
+  s.times[b.Ref()] = time.Now()
+  return nil
+}
+
+func (s *MemStore) Has(ref string) bool {
+  s.lock.RLock()
+  defer s.lock.RUnlock()
+
+  _, ok := s.blobs[ref]
+  return ok
+}
+
+func (s *MemStore) Stat(ref string) (size int64, err error) {
+  s.lock.RLock()
+  defer s.lock.RUnlock()
+
+  data, ok := s.blobs[ref]
+  if !ok {
+    return 0, NotFoundErr
+  }
+  return int64(len(data)), nil
+}
+
+func (s *MemStore) ModTime(ref string) (time.Time, error) {
+  s.lock.RLock()
+  defer s.lock.RUnlock()
+
+  t, ok := s.times[ref]
+  if !ok {
+    return time.Time{}, NotFoundErr
+  }
+  return t, nil
+}
+
+func (s *MemStore) Enumerate() chan string {
+  s.lock.RLock()
+  refs := make([]string, 0, len(s.blobs))
+  for ref := range s.blobs {
+    refs = append(refs, ref)
+  }
+  s.lock.RUnlock()
+  sort.Strings(refs)
+
+  ch := make(chan string)
+  go func() {
+    for _, ref := range refs {
+      ch <- ref
+    }
+    close(ch)
+  }()
+  return ch
+}
+
+func (s *MemStore) List(after string, max int) []string {
+  s.lock.RLock()
+  refs := []string{}
+  for ref := range s.blobs {
+    if ref > after {
+      refs = append(refs, ref)
+    }
+  }
+  s.lock.RUnlock()
+  return firstRefs(refs, max)
+}
+
+func (s *MemStore) Remove(ref string) error {
+  s.lock.Lock()
+  defer s.lock.Unlock()
+
+  if _, ok := s.blobs[ref]; !ok {
+    return NotFoundErr
+  }
+  delete(s.blobs, ref)
+  delete(s.times, ref)
+  return nil
+}
@@ -0,0 +1,588 @@
+package blobdb
+
+import (
+  "os"
+  "io"
+  "fmt"
+  "sort"
+  "sync"
+  "bufio"
+  "errors"
+  "strings"
+  "time"
+  "path/filepath"
+  "encoding/binary"
+  "github.com/rwcarlsen/cas/blob"
+)
+
+const (
+  DefaultSegmentSize = 1 << 28 // 256Mb
+  indexName = "pack.index"
+  segPrefix = "pack-"
+  segSuffix = ".pack"
+)
+
+// pack record operations
+const (
+  opPut byte = '+'
+  opRemove byte = '-'
+)
+
+var CorruptPackErr = errors.New("blobdb: corrupt pack file")
+
+type packEntry struct {
+  seg int
+  offset int64
+  length int64
+}
+
+// PackStore appends blobs to large segment files instead of using one file
+// per blob. A new segment is started once the current one grows beyond
+// SegmentSize bytes. Removals are recorded by appending a tombstone record
+// and the space is reclaimed by Compact.
+//
+// Each segment record is an operation byte, the ref length (uint16), the
+// ref, the data length (uint64) and the data. The ref -> (segment, offset,
+// length) index is persisted to an append-only index file so opening a
+// store doesn't require scanning every segment. If the index file is
+// missing it is rebuilt from the segments.
+type PackStore struct {
+  SegmentSize int64
+  location string
+  segs map[int]*os.File
+  active int
+  end int64
+  indf *os.File
+  index map[string]*packEntry
+  lock sync.RWMutex
+}
+
+func NewPackStore(loc string) (*PackStore, error) {
+  var mode os.FileMode = 0744
+  if err := os.MkdirAll(loc, mode); err != nil {
+    return nil, err
+  }
+
+  s := &PackStore{
+    SegmentSize: DefaultSegmentSize,
+    location: loc,
+    segs: map[int]*os.File{},
+    index: map[string]*packEntry{},
+  }
+  if err := s.load(); err != nil {
+    s.Close()
+    return nil, err
+  }
+  return s, nil
+}
+
+func (s *PackStore) segPath(seg int) string {
+  return filepath.Join(s.location, fmt.Sprintf("%v%06d%v", segPrefix, seg, segSuffix))
+}
+
+// segments returns the numbers of all segment files in sorted order.
+func (s *PackStore) segments() ([]int, error) {
+  names, err := filepath.Glob(filepath.Join(s.location, segPrefix + "*" + segSuffix))
+  if err != nil {
+    return nil, err
+  }
+
+  segs := []int{}
+  for _, name := range names {
+    var seg int
+    base := strings.TrimSuffix(filepath.Base(name), segSuffix)
+    if _, err := fmt.Sscanf(base, segPrefix + "%d", &seg); err == nil {
+      segs = append(segs, seg)
+    }
+  }
+  sort.Ints(segs)
+  return segs, nil
+}
+
+func (s *PackStore) segFile(seg int) (*os.File, error) {
+  if f, ok := s.segs[seg]; ok {
+    return f, nil
+  }
+  f, err := os.OpenFile(s.segPath(seg), os.O_RDWR | os.O_CREATE, 0644)
+  if err != nil {
+    return nil, err
+  }
+  s.segs[seg] = f
+  return f, nil
+}
+
+// load reads the persistent index (or rebuilds it from the segments) and
+// opens the newest segment for appending.
+func (s *PackStore) load() error {
+  segs, err := s.segments()
+  if err != nil {
+    return err
+  }
+
+  s.active = 1
+  if len(segs) > 0 {
+    s.active = segs[len(segs) - 1]
+  }
+  for _, seg := range segs {
+    if _, err := s.segFile(seg); err != nil {
+      return err
+    }
+  }
+
+  indPath := filepath.Join(s.location, indexName)
+  if _, err := os.Stat(indPath); os.IsNotExist(err) {
+    for _, seg := range segs {
+      if err := s.scanSegment(seg); err != nil {
+        return err
+      }
+    }
+    if err := s.writeIndex(indPath); err != nil {
+      return err
+    }
+  } else if err := s.readIndex(indPath); err != nil {
+    return err
+  }
+
+  s.indf, err = os.OpenFile(indPath, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644)
+  if err != nil {
+    return err
+  }
+
+  f, err := s.segFile(s.active)
+  if err != nil {
+    return err
+  }
+  info, err := f.Stat()
+  if err != nil {
+    return err
+  }
+  s.end = info.Size()
+  return nil
+}
+
+// scanSegment adds the records of a segment to the in-memory index.
+func (s *PackStore) scanSegment(seg int) error {
+  f, err := s.segFile(seg)
+  if err != nil {
+    return err
+  }
+  if _, err := f.Seek(0, 0); err != nil {
+    return err
+  }
+
+  r := bufio.NewReader(f)
+  var offset int64
+  for {
+    op, err := r.ReadByte()
+    if err == io.EOF {
+      return nil
+    } else if err != nil {
+      return err
+    }
+
+    var refLen uint16
+    if err := binary.Read(r, binary.BigEndian, &refLen); err != nil {
+      return CorruptPackErr
+    }
+    ref := make([]byte, refLen)
+    if _, err := io.ReadFull(r, ref); err != nil {
+      return CorruptPackErr
+    }
+    var dataLen uint64
+    if err := binary.Read(r, binary.BigEndian, &dataLen); err != nil {
+      return CorruptPackErr
+    }
+
+    dataOff := offset + 1 + 2 + int64(refLen) + 8
+    if _, err := r.Discard(int(dataLen)); err != nil {
+      return CorruptPackErr
+    }
+
+    switch op {
+      case opPut:
+        s.index[string(ref)] = &packEntry{seg: seg, offset: dataOff, length: int64(dataLen)}
+      case opRemove:
+        delete(s.index, string(ref))
+      default:
+        return CorruptPackErr
+    }
+    offset = dataOff + int64(dataLen)
+  }
+}
+
+// readIndex loads the index file. Each line is either
+// "+ <ref> <segment> <offset> <length>" or "- <ref>". A malformed or
+// unterminated last line is left from a write cut short by a crash (Put
+// only acknowledges blobs once their index line is synced) so it is
+// dropped and truncated away rather than making the store unopenable.
+func (s *PackStore) readIndex(pth string) error {
+  f, err := os.OpenFile(pth, os.O_RDWR, 0644)
+  if err != nil {
+    return err
+  }
+  defer f.Close()
+
+  r := bufio.NewReader(f)
+  var good int64
+  for {
+    line, err := r.ReadString('\n')
+    if err == io.EOF {
+      if line == "" {
+        return nil
+      }
+      return f.Truncate(good)
+    } else if err != nil {
+      return err
+    }
+
+    if perr := s.parseIndexLine(strings.TrimSpace(line)); perr != nil {
+      if _, err := r.Peek(1); err == io.EOF {
+        return f.Truncate(good)
+      }
+      return perr
+    }
+    good += int64(len(line))
+  }
+}
+
+func (s *PackStore) parseIndexLine(line string) error {
+  if line == "" {
+    return nil
+  }
+
+  var op, ref string
+  e := &packEntry{}
+  if _, err := fmt.Sscan(line, &op, &ref); err != nil {
+    return CorruptPackErr
+  }
+
+  switch op {
+    case string(opPut):
+      _, err := fmt.Sscan(line, &op, &ref, &e.seg, &e.offset, &e.length)
+      if err != nil {
+        return CorruptPackErr
+      }
+      s.index[ref] = e
+    case string(opRemove):
+      delete(s.index, ref)
+    default:
+      return CorruptPackErr
+  }
+  return nil
+}
+
+// writeIndex atomically replaces the index file with the current in-memory
+// index.
+func (s *PackStore) writeIndex(pth string) error {
+  tmp := pth + ".tmp"
+  f, err := os.Create(tmp)
+  if err != nil {
+    return err
+  }
+
+  w := bufio.NewWriter(f)
+  for ref, e := range s.index {
+    fmt.Fprintln(w, string(opPut), ref, e.seg, e.offset, e.length)
+  }
+  err = w.Flush()
+  if err == nil {
+    err = f.Sync()
+  }
+  if cerr := f.Close(); err == nil {
+    err = cerr
+  }
+  if err != nil {
+    os.Remove(tmp)
+    return err
+  }
+  return os.Rename(tmp, pth)
+}
+
+func (s *PackStore) Get(ref string) (*blob.Blob, error) {
+  s.lock.RLock()
+  defer s.lock.RUnlock()
+
+  e, ok := s.index[ref]
+  if !ok {
+    return nil, NotFoundErr
+  }
+
+  f, ok := s.segs[e.seg]
+  if !ok {
+    return nil, CorruptPackErr
+  }
+
+  data := make([]byte, e.length)
+  if _, err := f.ReadAt(data, e.offset); err != nil {
+    return nil, err
+  }
+  return newBlob(ref, data), nil
+}
+
+func (s *PackStore) Put(b *blob.Blob) error {
+  s.lock.Lock()
+  defer s.lock.Unlock()
+
+  ref := b.Ref()
+  data := b.Content()
+  e, err := s.append(opPut, ref, data)
+  if err != nil {
+    return err
+  }
+
+  // the index must never point at data that isn't on disk
+  if err := s.segs[e.seg].Sync(); err != nil {
+    return err
+  }
+
+  _, err = fmt.Fprintln(s.indf, string(opPut), ref, e.seg, e.offset, e.length)
+  if err != nil {
+    return err
+  } else if err := s.indf.Sync(); err != nil {
+    return err
+  }
+  s.index[ref] = e
+  return nil
+}
+
+// append writes a record to the end of the active segment (starting a new
+// one if it is full) and returns the location of its data.
+func (s *PackStore) append(op byte, ref string, data []byte) (*packEntry, error) {
+  if s.end > 0 && s.end + int64(len(data)) > s.SegmentSize {
+    s.active++
+    s.end = 0
+  }
+
+  f, err := s.segFile(s.active)
+  if err != nil {
+    return nil, err
+  }
+
+  rec := make([]byte, 0, 1 + 2 + len(ref) + 8 + len(data))
+  rec = append(rec, op)
+  rec = append(rec, byte(len(ref) >> 8), byte(len(ref)))
+  rec = append(rec, ref...)
+  var n [8]byte
+  binary.BigEndian.PutUint64(n[:], uint64(len(data)))
+  rec = append(rec, n[:]...)
+  rec = append(rec, data...)
+
+  if _, err := f.WriteAt(rec, s.end); err != nil {
+    return nil, err
+  }
+
+  e := &packEntry{
+    seg: s.active,
+    offset: s.end + int64(len(rec) - len(data)),
+    length: int64(len(data)),
+  }
+  s.end += int64(len(rec))
+  return e, nil
+}
+
+func (s *PackStore) Has(ref string) bool {
+  s.lock.RLock()
+  defer s.lock.RUnlock()
+
+  _, ok := s.index[ref]
+  return ok
+}
+
+func (s *PackStore) Stat(ref string) (size int64, err error) {
+  s.lock.RLock()
+  defer s.lock.RUnlock()
+
+  e, ok := s.index[ref]
+  if !ok {
+    return 0, NotFoundErr
+  }
+  return e.length, nil
+}
+
+// ModTime returns the last modification time of the segment holding ref
+// which is never earlier than the time the blob was written.
+func (s *PackStore) ModTime(ref string) (time.Time, error) {
+  s.lock.RLock()
+  defer s.lock.RUnlock()
+
+  e, ok := s.index[ref]
+  if !ok {
+    return time.Time{}, NotFoundErr
+  }
+
+  f, ok := s.segs[e.seg]
+  if !ok {
+    return time.Time{}, CorruptPackErr
+  }
+  info, err := f.Stat()
+  if err != nil {
+    return time.Time{}, err
+  }
+  return info.ModTime(), nil
+}
+
+func (s *PackStore) Enumerate() chan string {
+  s.lock.RLock()
+  refs := make([]string, 0, len(s.index))
+  for ref := range s.index {
+    refs = append(refs, ref)
+  }
+  s.lock.RUnlock()
+  sort.Strings(refs)
+
+  ch := make(chan string)
+  go func() {
+    for _, ref := range refs {
+      ch <- ref
+    }
+    close(ch)
+  }()
+  return ch
+}
+
+func (s *PackStore) List(after string, max int) []string {
+  s.lock.RLock()
+  refs := []string{}
+  for ref := range s.index {
+    if ref > after {
+      refs = append(refs, ref)
+    }
+  }
+  s.lock.RUnlock()
+  return firstRefs(refs, max)
+}
+
+func (s *PackStore) Remove(ref string) error {
+  s.lock.Lock()
+  defer s.lock.Unlock()
+
+  if _, ok := s.index[ref]; !ok {
+    return NotFoundErr
+  }
+
+  if _, err := s.append(opRemove, ref, nil); err != nil {
+    return err
+  }
+  if _, err := fmt.Fprintln(s.indf, string(opRemove), ref); err != nil {
+    return err
+  } else if err := s.indf.Sync(); err != nil {
+    return err
+  }
+  delete(s.index, ref)
+  return nil
+}
+
+type byLocation []*packEntry
+
+func (l byLocation) Len() int { return len(l) }
+func (l byLocation) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l byLocation) Less(i, j int) bool {
+  if l[i].seg != l[j].seg {
+    return l[i].seg < l[j].seg
+  }
+  return l[i].offset < l[j].offset
+}
+
+// Compact copies every live blob into fresh segments, replaces the index
+// and deletes the old segments, dropping removed blobs and tombstones. It
+// returns the number of bytes reclaimed.
+func (s *PackStore) Compact() (reclaimed int64, err error) {
+  s.lock.Lock()
+  defer s.lock.Unlock()
+
+  old, err := s.segments()
+  if err != nil {
+    return 0, err
+  }
+
+  var before int64
+  for _, seg := range old {
+    if info, err := os.Stat(s.segPath(seg)); err == nil {
+      before += info.Size()
+    }
+  }
+
+  entries := make([]*packEntry, 0, len(s.index))
+  refs := map[*packEntry]string{}
+  for ref, e := range s.index {
+    entries = append(entries, e)
+    refs[e] = ref
+  }
+  sort.Sort(byLocation(entries))
+
+  // start writing into a brand new segment
+  s.active++
+  s.end = 0
+  first := s.active
+
+  newIndex := make(map[string]*packEntry, len(entries))
+  for _, e := range entries {
+    f, ok := s.segs[e.seg]
+    if !ok {
+      return 0, CorruptPackErr
+    }
+    data := make([]byte, e.length)
+    if _, err := f.ReadAt(data, e.offset); err != nil {
+      return 0, err
+    }
+
+    ne, err := s.append(opPut, refs[e], data)
+    if err != nil {
+      return 0, err
+    }
+    newIndex[refs[e]] = ne
+  }
+
+  var after int64
+  for seg := first; seg <= s.active; seg++ {
+    f, err := s.segFile(seg)
+    if err != nil {
+      return 0, err
+    }
+    if err := f.Sync(); err != nil {
+      return 0, err
+    }
+    if info, err := f.Stat(); err == nil {
+      after += info.Size()
+    }
+  }
+
+  // swap in the new index before deleting anything it no longer references
+  oldIndex := s.index
+  s.index = newIndex
+  indPath := filepath.Join(s.location, indexName)
+  if err := s.writeIndex(indPath); err != nil {
+    s.index = oldIndex
+    return 0, err
+  }
+
+  s.indf.Close()
+  s.indf, err = os.OpenFile(indPath, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644)
+  if err != nil {
+    return 0, err
+  }
+
+  for _, seg := range old {
+    if f, ok := s.segs[seg]; ok {
+      f.Close()
+      delete(s.segs, seg)
+    }
+    os.Remove(s.segPath(seg))
+  }
+
+  return before - after, nil
+}
+
+// Close releases the segment and index files.
+func (s *PackStore) Close() error {
+  s.lock.Lock()
+  defer s.lock.Unlock()
+
+  for _, f := range s.segs {
+    f.Close()
+  }
+  if s.indf != nil {
+    return s.indf.Close()
+  }
+  return nil
+}
@@ -0,0 +1,172 @@
+package blobdb
+
+import (
+  "os"
+  "fmt"
+  "testing"
+  "io/ioutil"
+  "path/filepath"
+  "github.com/rwcarlsen/cas/blob"
+)
+
+func packBlobs(n int) []*blob.Blob {
+  blobs := []*blob.Blob{}
+  for i := 0; i < n; i++ {
+    blobs = append(blobs, blob.NewRaw([]byte(fmt.Sprintf("pack blob %v", i))))
+  }
+  return blobs
+}
+
+// checkPack verifies s holds exactly the blobs in want.
+func checkPack(t *testing.T, s *PackStore, want []*blob.Blob, gone []*blob.Blob) {
+  for _, b := range want {
+    got, err := s.Get(b.Ref())
+    if err != nil {
+      t.Fatalf("get %v: %v", b.Ref(), err)
+    } else if string(got.Content()) != string(b.Content()) {
+      t.Fatalf("blob %v has the wrong content", b.Ref())
+    }
+  }
+  for _, b := range gone {
+    if s.Has(b.Ref()) {
+      t.Fatalf("removed blob %v is still there", b.Ref())
+    }
+  }
+}
+
+func openPack(t *testing.T, dir string) *PackStore {
+  s, err := NewPackStore(dir)
+  if err != nil {
+    t.Fatal(err)
+  }
+  s.SegmentSize = 64
+  return s
+}
+
+func TestPackReopen(t *testing.T) {
+  dir, err := ioutil.TempDir("", "pack")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  s := openPack(t, dir)
+  blobs := packBlobs(20)
+  for _, b := range blobs {
+    if err := s.Put(b); err != nil {
+      t.Fatal(err)
+    }
+  }
+  for _, b := range blobs[:5] {
+    if err := s.Remove(b.Ref()); err != nil {
+      t.Fatal(err)
+    }
+  }
+  s.Close()
+
+  s = openPack(t, dir)
+  checkPack(t, s, blobs[5:], blobs[:5])
+  s.Close()
+
+  // without the index file it is rebuilt from the segments
+  if err := os.Remove(filepath.Join(dir, indexName)); err != nil {
+    t.Fatal(err)
+  }
+  s = openPack(t, dir)
+  checkPack(t, s, blobs[5:], blobs[:5])
+  s.Close()
+}
+
+func TestPackCompact(t *testing.T) {
+  dir, err := ioutil.TempDir("", "pack")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  s := openPack(t, dir)
+  blobs := packBlobs(20)
+  for _, b := range blobs {
+    if err := s.Put(b); err != nil {
+      t.Fatal(err)
+    }
+  }
+  for _, b := range blobs[:10] {
+    if err := s.Remove(b.Ref()); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  n, err := s.Compact()
+  if err != nil {
+    t.Fatal(err)
+  } else if n <= 0 {
+    t.Errorf("compaction reclaimed %v bytes", n)
+  }
+  checkPack(t, s, blobs[10:], blobs[:10])
+
+  // blobs put after compaction survive a reopen along with the rest
+  more := packBlobs(25)[20:]
+  for _, b := range more {
+    if err := s.Put(b); err != nil {
+      t.Fatal(err)
+    }
+  }
+  s.Close()
+
+  s = openPack(t, dir)
+  defer s.Close()
+  checkPack(t, s, append(blobs[10:], more...), blobs[:10])
+}
+
+func TestPackTornIndex(t *testing.T) {
+  dir, err := ioutil.TempDir("", "pack")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  s := openPack(t, dir)
+  blobs := packBlobs(10)
+  for _, b := range blobs[:5] {
+    if err := s.Put(b); err != nil {
+      t.Fatal(err)
+    }
+  }
+  s.Close()
+
+  // a crash part way through writing an index line
+  indPath := filepath.Join(dir, indexName)
+  f, err := os.OpenFile(indPath, os.O_WRONLY | os.O_APPEND, 0644)
+  if err != nil {
+    t.Fatal(err)
+  }
+  fmt.Fprint(f, string(opPut), " ", blobs[5].Ref(), " 1 ")
+  f.Close()
+
+  s = openPack(t, dir)
+  checkPack(t, s, blobs[:5], blobs[5:])
+  for _, b := range blobs[5:] {
+    if err := s.Put(b); err != nil {
+      t.Fatal(err)
+    }
+  }
+  s.Close()
+
+  s = openPack(t, dir)
+  checkPack(t, s, blobs, nil)
+  s.Close()
+
+  // damage anywhere but the end is still corruption
+  data, err := ioutil.ReadFile(indPath)
+  if err != nil {
+    t.Fatal(err)
+  }
+  data = append([]byte("+ garbage\n"), data...)
+  if err := ioutil.WriteFile(indPath, data, 0644); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := NewPackStore(dir); err != CorruptPackErr {
+    t.Errorf("got err %v, want %v", err, CorruptPackErr)
+  }
+}
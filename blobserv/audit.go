@@ -0,0 +1,62 @@
+package blobserv
+
+import (
+  "fmt"
+  "net/http"
+  "io/ioutil"
+  "encoding/json"
+  "github.com/rwcarlsen/cas/auth"
+  "github.com/rwcarlsen/cas/util"
+  "github.com/rwcarlsen/cas/blobserv/audit"
+)
+
+// record writes e to the server's audit log (if it has one) along with the
+// request's authenticated principal and remote address.
+func (bs *Server) record(req *http.Request, e *audit.Entry) {
+  if bs.Audit == nil {
+    return
+  }
+
+  e.Principal = auth.Identity(req)
+  e.Remote = req.RemoteAddr
+  if err := bs.Audit.Record(e); err != nil {
+    fmt.Println("audit log write failed: ", err)
+  }
+}
+
+// auditHandler answers json encoded audit.Request queries with a json list
+// of matching audit entries, newest first.
+type auditHandler struct {
+  bs *Server
+}
+
+func (h *auditHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+  defer func() {
+    if r := recover(); r != nil {
+      sendErr(w, r)
+      fmt.Println("audit query failed: ", r)
+    }
+  }()
+
+  if h.bs.Audit == nil {
+    panic("server has no audit log")
+  }
+
+  data, err := ioutil.ReadAll(req.Body)
+  util.Check(err)
+
+  q := &audit.Request{}
+  if err := json.Unmarshal(data, q); err != nil {
+    panic(BadRequestErr)
+  }
+
+  data, err = json.Marshal(h.bs.Audit.Find(q))
+  util.Check(err)
+
+  w.Header().Set(ActionStatus, ActionSuccess)
+  w.Write(data)
+}
+
+func (h *auditHandler) Unauthorized(w http.ResponseWriter, req *http.Request) {
+  deny(w, req)
+}
@@ -0,0 +1,261 @@
+// audit records blob server accesses to a rotated json lines log and keeps
+// the most recent entries in memory for querying.
+package audit
+
+import (
+  "os"
+  "fmt"
+  "sync"
+  "time"
+  "bufio"
+  "encoding/json"
+  "path/filepath"
+)
+
+const (
+  DefaultMaxSize = 64 << 20 // 64 Mb
+  DefaultKeep = 8
+  DefaultMaxEntries = 100000
+  logName = "audit.log"
+)
+
+// Operations
+const (
+  Get = "get"
+  Put = "put"
+  Query = "index"
+)
+
+// Results
+const (
+  Ok = "ok"
+  Dup = "dup" // put of a blob that was already stored
+  Denied = "denied"
+  Failed = "failed"
+)
+
+// Entry is a single audited request.
+type Entry struct {
+  Time time.Time
+  Principal string `json:",omitempty"` // authenticated user name or key id
+  Share string `json:",omitempty"` // share ref the request was authorized through
+  Capability bool `json:",omitempty"` // authorized through a signed url
+  Remote string `json:",omitempty"`
+  Op string
+  Ref string `json:",omitempty"`
+  Index string `json:",omitempty"` // index name for queries
+  Bytes int64
+  Result string
+}
+
+// Request selects entries from a Log. Empty fields match everything.
+type Request struct {
+  Principal string
+  Share string
+  Op string
+  Ref string
+  Result string
+  Since time.Time
+  Max int // 0 returns all matches
+}
+
+func (r *Request) match(e *Entry) bool {
+  switch {
+  case r.Principal != "" && r.Principal != e.Principal:
+  case r.Share != "" && r.Share != e.Share:
+  case r.Op != "" && r.Op != e.Op:
+  case r.Ref != "" && r.Ref != e.Ref:
+  case r.Result != "" && r.Result != e.Result:
+  case e.Time.Before(r.Since):
+  default:
+    return true
+  }
+  return false
+}
+
+// Log appends entries to dir/audit.log. Once the file is MaxSize bytes it
+// is rotated to audit.log.1 (shifting older files up) and only Keep
+// rotated files are kept. The latest MaxEntries entries are indexed for
+// Find.
+type Log struct {
+  MaxSize int64
+  Keep int
+  MaxEntries int
+  dir string
+  f *os.File
+  size int64
+  entries []*Entry
+  lock sync.Mutex
+}
+
+// Open opens the audit log in dir, loading existing entries into the
+// index.
+func Open(dir string) (*Log, error) {
+  if err := os.MkdirAll(dir, 0700); err != nil {
+    return nil, err
+  }
+
+  l := &Log{
+    MaxSize: DefaultMaxSize,
+    Keep: DefaultKeep,
+    MaxEntries: DefaultMaxEntries,
+    dir: dir,
+  }
+
+  // only read as many files (newest first) as it takes to fill the index
+  files := [][]*Entry{}
+  for i, n := 0, 0; i <= DefaultKeep && n < l.MaxEntries; i++ {
+    entries, err := load(l.path(i))
+    if os.IsNotExist(err) {
+      continue
+    } else if err != nil {
+      return nil, err
+    }
+    files = append(files, entries)
+    n += len(entries)
+  }
+  for i := len(files) - 1; i >= 0; i-- {
+    for _, e := range files[i] {
+      l.index(e)
+    }
+  }
+  return l, l.open()
+}
+
+func (l *Log) path(i int) string {
+  if i == 0 {
+    return filepath.Join(l.dir, logName)
+  }
+  return filepath.Join(l.dir, fmt.Sprint(logName, ".", i))
+}
+
+func load(pth string) ([]*Entry, error) {
+  f, err := os.Open(pth)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+
+  entries := []*Entry{}
+  scan := bufio.NewScanner(f)
+  for scan.Scan() {
+    e := &Entry{}
+    if err := json.Unmarshal(scan.Bytes(), e); err == nil {
+      entries = append(entries, e)
+    }
+  }
+  return entries, scan.Err()
+}
+
+func (l *Log) open() error {
+  f, err := os.OpenFile(l.path(0), os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0600)
+  if err != nil {
+    return err
+  }
+  info, err := f.Stat()
+  if err != nil {
+    f.Close()
+    return err
+  }
+  l.f, l.size = f, info.Size()
+  return nil
+}
+
+// rotate shifts the log files up. The current file is always reopened
+// (even if a rename failed) so one failed rotation doesn't stop all later
+// records; the rotation is retried by the next Record.
+func (l *Log) rotate() error {
+  l.f.Close()
+  os.Remove(l.path(l.Keep))
+
+  var err error
+  for i := l.Keep - 1; i >= 0 && err == nil; i-- {
+    if err = os.Rename(l.path(i), l.path(i + 1)); os.IsNotExist(err) {
+      err = nil
+    }
+  }
+  if oerr := l.open(); err == nil {
+    err = oerr
+  }
+  return err
+}
+
+func (l *Log) index(e *Entry) {
+  l.entries = append(l.entries, e)
+  if over := len(l.entries) - l.MaxEntries; over > l.MaxEntries / 4 {
+    l.entries = append([]*Entry{}, l.entries[over:]...)
+  }
+}
+
+// Record writes e to the log and indexes it. A zero e.Time is set to the
+// current time.
+func (l *Log) Record(e *Entry) error {
+  if e.Time.IsZero() {
+    e.Time = time.Now()
+  }
+
+  data, err := json.Marshal(e)
+  if err != nil {
+    return err
+  }
+
+  l.lock.Lock()
+  defer l.lock.Unlock()
+
+  l.index(e)
+  var rerr error
+  if l.size >= l.MaxSize {
+    rerr = l.rotate()
+  }
+  n, err := l.f.Write(append(data, '\n'))
+  l.size += int64(n)
+  if err != nil {
+    return err
+  }
+  return rerr
+}
+
+// Find returns indexed entries matching r, newest first.
+func (l *Log) Find(r *Request) []*Entry {
+  l.lock.Lock()
+  defer l.lock.Unlock()
+
+  found := []*Entry{}
+  start := len(l.entries) - l.MaxEntries
+  if start < 0 {
+    start = 0
+  }
+  for i := len(l.entries) - 1; i >= start; i-- {
+    if r.Max > 0 && len(found) == r.Max {
+      break
+    }
+    if r.match(l.entries[i]) {
+      found = append(found, l.entries[i])
+    }
+  }
+  return found
+}
+
+// Summary returns the principals and shares (as "share:<ref>") that
+// successfully retrieved ref along with how many times each did.
+func (l *Log) Summary(ref string) map[string]int {
+  who := map[string]int{}
+  for _, e := range l.Find(&Request{Ref: ref, Op: Get, Result: Ok}) {
+    switch {
+    case e.Share != "":
+      who["share:" + e.Share]++
+    case e.Capability:
+      who["signed-url"]++
+    default:
+      who[e.Principal]++
+    }
+  }
+  return who
+}
+
+// Close closes the underlying log file.
+func (l *Log) Close() error {
+  l.lock.Lock()
+  defer l.lock.Unlock()
+  return l.f.Close()
+}
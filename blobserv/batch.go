@@ -0,0 +1,131 @@
+package blobserv
+
+import (
+  "fmt"
+  "bufio"
+  "strings"
+  "net/http"
+  "net/textproto"
+  "encoding/json"
+  "mime"
+  "mime/multipart"
+  "github.com/rwcarlsen/cas/blobdb"
+  "github.com/rwcarlsen/cas/blobserv/audit"
+)
+
+const (
+  // MaxBatch is the most blobs a single batch get or put may hold.
+  MaxBatch = 1000
+  // StatusField is set on each part of a batch get response to the http
+  // status of that blob's retrieval.
+  StatusField = "Blob-Status"
+)
+
+// PutResult reports the outcome of storing one blob of a batch put.
+type PutResult struct {
+  Ref string
+  Status int // http status as for a single blob put
+}
+
+func isBatch(req *http.Request) bool {
+  mt, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+  return req.Method == "POST" && (mt == "multipart/form-data" || mt == "text/plain")
+}
+
+// batchGet streams the blobs for the newline separated refs in the request
+// body back as multipart/mixed parts named by ref. Parts for blobs that
+// couldn't be retrieved are empty and have a StatusField other than 200.
+func (h *getHandler) batchGet(w http.ResponseWriter, req *http.Request) {
+  refs := []string{}
+  scan := bufio.NewScanner(req.Body)
+  for scan.Scan() {
+    if ref := strings.TrimSpace(scan.Text()); ref != "" {
+      refs = append(refs, ref)
+    }
+  }
+  if scan.Err() != nil || len(refs) > MaxBatch {
+    sendErr(w, BadRequestErr)
+    return
+  }
+
+  mw := multipart.NewWriter(w)
+  defer mw.Close()
+  w.Header().Set("Content-Type", "multipart/mixed")
+  w.Header().Set(BoundaryField, mw.Boundary())
+  w.Header().Set(ActionStatus, ActionSuccess)
+
+  for _, ref := range refs {
+    e := &audit.Entry{Op: audit.Get, Ref: ref, Result: audit.Failed}
+    b, err := h.bs.Db.Get(ref)
+
+    hdr := textproto.MIMEHeader{}
+    hdr.Set("Content-Disposition", fmt.Sprintf(`form-data; name="blob"; filename=%q`, ref))
+    if err != nil {
+      hdr.Set(StatusField, fmt.Sprint(statusFor(err)))
+    } else {
+      hdr.Set(StatusField, fmt.Sprint(http.StatusOK))
+    }
+
+    part, perr := mw.CreatePart(hdr)
+    if perr != nil {
+      h.bs.record(req, e)
+      return
+    }
+    if err == nil {
+      part.Write(b.Content())
+      e.Bytes, e.Result = int64(len(b.Content())), audit.Ok
+    }
+    h.bs.record(req, e)
+  }
+}
+
+// batchPut stores each part of a multipart/form-data request body as a
+// blob. A part's file name, if not empty, is the blob's declared ref. The
+// response is a json list of PutResults in part order.
+func (h *putHandler) batchPut(w http.ResponseWriter, req *http.Request) {
+  mr, err := req.MultipartReader()
+  if err != nil {
+    sendErr(w, BadRequestErr)
+    return
+  }
+
+  results := []*PutResult{}
+  for len(results) < MaxBatch {
+    part, err := mr.NextPart()
+    if err != nil {
+      break
+    }
+
+    preq := &http.Request{Header: http.Header{}, Body: part, URL: req.URL}
+    preq.Header.Set(RefField, part.FileName())
+    b, err := readBlob(preq)
+
+    res := &PutResult{Ref: part.FileName(), Status: http.StatusOK}
+    e := &audit.Entry{Op: audit.Put, Ref: res.Ref, Result: audit.Failed}
+    if err == nil {
+      res.Ref, e.Ref, e.Bytes = b.Ref(), b.Ref(), int64(len(b.Content()))
+      if err = checkShare(b); err == nil {
+        err = h.bs.store(b)
+      }
+    }
+
+    switch {
+    case err == nil:
+      e.Result = audit.Ok
+    case err == blobdb.DupContentErr:
+      e.Result = audit.Dup
+    default:
+      res.Status = statusFor(err)
+    }
+    h.bs.record(req, e)
+    results = append(results, res)
+  }
+
+  data, err := json.Marshal(results)
+  if err != nil {
+    sendErr(w, err)
+    return
+  }
+  w.Header().Set(ActionStatus, ActionSuccess)
+  w.Write(data)
+}
@@ -0,0 +1,170 @@
+package blobserv
+
+import (
+  "fmt"
+  "time"
+  "errors"
+  "strconv"
+  "net/url"
+  "net/http"
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/hex"
+  "github.com/rwcarlsen/cas/blob"
+  "github.com/rwcarlsen/cas/blobserv/objindex"
+)
+
+const (
+  // DefaultURLTTL is how long signed urls are valid if no ttl is
+  // requested.
+  DefaultURLTTL = 24 * time.Hour
+  // DefaultMaxURLTTL is the longest ttl signed urls may have if the
+  // server's MaxURLTTL is zero.
+  DefaultMaxURLTTL = 30 * 24 * time.Hour
+)
+
+var BadURLKeyErr = errors.New("blobserv: url signing key must be at least 32 bytes")
+
+// NewURLKey returns a random key for signing capability urls.
+func NewURLKey() []byte {
+  key := make([]byte, 32)
+  if _, err := rand.Read(key); err != nil {
+    panic(err)
+  }
+  return key
+}
+
+// URLKeyID returns the id urls signed with key carry so the key that
+// signed them can be found among a server's current and retired keys.
+func URLKeyID(key []byte) string {
+  sum := sha256.Sum256(key)
+  return hex.EncodeToString(sum[:4])
+}
+
+// capMac returns the signature by key of a capability for ref (or for any
+// blob in the history of object objref if it is not empty) expiring at
+// exp.
+func capMac(key []byte, ref, objref string, exp int64) string {
+  scope := "ref:" + ref
+  if objref != "" {
+    scope = "obj:" + objref
+  }
+
+  mac := hmac.New(sha256.New, key)
+  fmt.Fprintf(mac, "%v\n%v\n%v", URLKeyID(key), scope, exp)
+  return hex.EncodeToString(mac.Sum(nil))
+}
+
+// urlKey returns the current or retired url key with the given id.
+func (bs *Server) urlKey(id string) []byte {
+  for _, key := range append([][]byte{bs.URLKey}, bs.OldURLKeys...) {
+    if len(key) > 0 && URLKeyID(key) == id {
+      return key
+    }
+  }
+  return nil
+}
+
+func (bs *Server) maxURLTTL() time.Duration {
+  if bs.MaxURLTTL <= 0 {
+    return DefaultMaxURLTTL
+  }
+  return bs.MaxURLTTL
+}
+
+// SignURL returns the path and query of a url that retrieves ref without
+// authentication until exp. If objref is not empty, the url's parameters
+// are instead good for any version of object objref and the content refs
+// of its versions. Urls for file metas retrieve the file's content (see
+// fileHandler) rather than the meta.
+func (bs *Server) SignURL(ref, objref string, exp time.Time) string {
+  v := url.Values{}
+  if objref != "" {
+    v.Set("obj", objref)
+  }
+  v.Set("exp", strconv.FormatInt(exp.Unix(), 10))
+  v.Set("kid", URLKeyID(bs.URLKey))
+  v.Set("sig", capMac(bs.URLKey, ref, objref, exp.Unix()))
+
+  if b, err := bs.Db.Get(ref); err == nil && b.Type() == blob.MetaType {
+    return "/file/" + ref + "?" + v.Encode()
+  }
+  return "/ref/" + ref + "?" + v.Encode()
+}
+
+// capAllows returns true if req carries an unexpired capability signed by
+// one of bs's url keys that covers b. Capabilities expiring further out
+// than the server's MaxURLTTL are refused.
+func (bs *Server) capAllows(req *http.Request, b *blob.Blob) bool {
+  exp, err := strconv.ParseInt(req.FormValue("exp"), 10, 64)
+  now := time.Now()
+  if err != nil || now.Unix() > exp || exp > now.Add(bs.maxURLTTL()).Unix() {
+    return false
+  }
+
+  key := bs.urlKey(req.FormValue("kid"))
+  if key == nil {
+    return false
+  }
+
+  objref := req.FormValue("obj")
+  want := capMac(key, b.Ref(), objref, exp)
+  if !hmac.Equal([]byte(want), []byte(req.FormValue("sig"))) {
+    return false
+  } else if objref == "" {
+    return true
+  }
+  return bs.inObject(objref, b)
+}
+
+// inObject returns true if b is object objref, one of its versions or
+// part of the content of one of its versions.
+func (bs *Server) inObject(objref string, b *blob.Blob) bool {
+  if b.Ref() == objref || b.ObjectRef() == objref {
+    return true
+  }
+
+  objects, ok := bs.inds["object"].(*objindex.ObjectIndex)
+  return ok && objects.HasContent(objref, b.Ref())
+}
+
+// signHandler mints capability urls for authenticated users. The ref,
+// obj and ttl (e.g. "36h") form values select what the url retrieves and
+// for how long. Ttls over the server's MaxURLTTL are refused.
+type signHandler struct {
+  bs *Server
+}
+
+func (h *signHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+  defer func() {
+    if r := recover(); r != nil {
+      sendErr(w, r)
+      fmt.Println("url signing failed: ", r)
+    }
+  }()
+
+  ttl := DefaultURLTTL
+  if s := req.FormValue("ttl"); s != "" {
+    var err error
+    ttl, err = time.ParseDuration(s)
+    if err != nil || ttl <= 0 || ttl > h.bs.maxURLTTL() {
+      panic(BadRequestErr)
+    }
+  }
+
+  ref, objref := req.FormValue("ref"), req.FormValue("obj")
+  if ref == "" {
+    ref = objref
+  }
+  if _, _, err := blob.ParseRef(ref); err != nil {
+    panic(err)
+  }
+
+  w.Header().Set(ActionStatus, ActionSuccess)
+  w.Write([]byte(h.bs.SignURL(ref, objref, time.Now().Add(ttl))))
+}
+
+func (h *signHandler) Unauthorized(w http.ResponseWriter, req *http.Request) {
+  deny(w, req)
+}
@@ -0,0 +1,167 @@
+package blobserv
+
+import (
+  "fmt"
+  "time"
+  "strings"
+  "testing"
+  "net/url"
+  "net/http"
+  "net/http/httptest"
+  "github.com/rwcarlsen/cas/blob"
+)
+
+// capAllowed returns true if the signed url u (with its query edited by
+// edit if not nil) grants retrieval of b.
+func capAllowed(t *testing.T, bs *Server, u string, b *blob.Blob, edit func(url.Values)) bool {
+  parsed, err := url.Parse(u)
+  if err != nil {
+    t.Fatal(err)
+  }
+  v := parsed.Query()
+  if edit != nil {
+    edit(v)
+  }
+  req := httptest.NewRequest("GET", parsed.Path + "?" + v.Encode(), nil)
+  return bs.capAllows(req, b)
+}
+
+func TestCapabilityMAC(t *testing.T) {
+  b := blob.NewRaw([]byte("shared"))
+  other := blob.NewRaw([]byte("not shared"))
+  bs := testServer(t, b, other)
+  bs.URLKey = NewURLKey()
+
+  exp := time.Now().Add(time.Hour)
+  u := bs.SignURL(b.Ref(), "", exp)
+  if !strings.HasPrefix(u, "/ref/" + b.Ref() + "?") {
+    t.Fatalf("bad signed url %v", u)
+  }
+
+  tests := []struct {
+    desc string
+    b *blob.Blob
+    edit func(url.Values)
+    want bool
+  }{
+    {"signed url", b, nil, true},
+    {"other blob", other, nil, false},
+    {"later exp", b, func(v url.Values) { v.Set("exp", fmt.Sprint(exp.Add(time.Hour).Unix())) }, false},
+    {"object scope", b, func(v url.Values) { v.Set("obj", b.Ref()) }, false},
+    {"bad sig", b, func(v url.Values) { v.Set("sig", strings.Repeat("0", 64)) }, false},
+    {"no sig", b, func(v url.Values) { v.Del("sig") }, false},
+    {"unknown kid", b, func(v url.Values) { v.Set("kid", URLKeyID(NewURLKey())) }, false},
+    {"no kid", b, func(v url.Values) { v.Del("kid") }, false},
+  }
+
+  for _, test := range tests {
+    if got := capAllowed(t, bs, u, test.b, test.edit); got != test.want {
+      t.Errorf("%v: got %v, want %v", test.desc, got, test.want)
+    }
+  }
+}
+
+func TestCapabilityExpiry(t *testing.T) {
+  b := blob.NewRaw([]byte("shared"))
+  bs := testServer(t, b)
+  bs.URLKey = NewURLKey()
+  bs.MaxURLTTL = 48 * time.Hour
+
+  now := time.Now()
+  tests := []struct {
+    exp time.Time
+    want bool
+  }{
+    {now.Add(time.Minute), true},
+    {now.Add(47 * time.Hour), true},
+    {now.Add(-time.Minute), false},
+    {now.Add(49 * time.Hour), false},
+  }
+
+  for _, test := range tests {
+    u := bs.SignURL(b.Ref(), "", test.exp)
+    if got := capAllowed(t, bs, u, b, nil); got != test.want {
+      t.Errorf("exp in %v: got %v, want %v", test.exp.Sub(now), got, test.want)
+    }
+  }
+}
+
+func TestCapabilityKeyRotation(t *testing.T) {
+  b := blob.NewRaw([]byte("shared"))
+  bs := testServer(t, b)
+  old := NewURLKey()
+  bs.URLKey = old
+  u := bs.SignURL(b.Ref(), "", time.Now().Add(time.Hour))
+
+  bs.URLKey, bs.OldURLKeys = NewURLKey(), [][]byte{old}
+  if !capAllowed(t, bs, u, b, nil) {
+    t.Errorf("url signed by a retired key was refused")
+  }
+  // claiming the current key's id doesn't make the old signature valid
+  if capAllowed(t, bs, u, b, func(v url.Values) { v.Set("kid", URLKeyID(bs.URLKey)) }) {
+    t.Errorf("url signed by a retired key was accepted under the current key's id")
+  }
+
+  bs.OldURLKeys = nil
+  if capAllowed(t, bs, u, b, nil) {
+    t.Errorf("url signed by a dropped key was accepted")
+  }
+}
+
+func TestCapabilityObject(t *testing.T) {
+  obj := blob.NewObject()
+  content := blob.NewRaw([]byte("file data"))
+  m := blob.NewMeta()
+  m.RcasObjectRef = obj.Ref()
+  m.ContentRefs = []string{content.Ref()}
+  meta, err := blob.Marshal(m)
+  if err != nil {
+    t.Fatal(err)
+  }
+  other := blob.NewRaw([]byte("not shared"))
+  bs := testServer(t, obj, content, meta, other)
+  bs.URLKey = NewURLKey()
+
+  u := bs.SignURL(obj.Ref(), obj.Ref(), time.Now().Add(time.Hour))
+  for _, b := range []*blob.Blob{obj, meta, content} {
+    if !capAllowed(t, bs, u, b, nil) {
+      t.Errorf("object url refused blob %v", b.Ref())
+    }
+  }
+  if capAllowed(t, bs, u, other, nil) {
+    t.Errorf("object url granted a blob outside the object")
+  }
+
+  u = bs.SignURL(meta.Ref(), "", time.Now().Add(time.Hour))
+  if !strings.HasPrefix(u, "/file/" + meta.Ref() + "?") {
+    t.Errorf("url for a file meta is %v, want a /file/ url", u)
+  }
+}
+
+func TestSignTTL(t *testing.T) {
+  b := blob.NewRaw([]byte("shared"))
+  bs := testServer(t, b)
+  bs.URLKey = NewURLKey()
+  bs.MaxURLTTL = 48 * time.Hour
+
+  tests := []struct {
+    ttl string
+    want int
+  }{
+    {"", http.StatusOK},
+    {"36h", http.StatusOK},
+    {"49h", http.StatusBadRequest},
+    {"0s", http.StatusBadRequest},
+    {"-1h", http.StatusBadRequest},
+    {"soon", http.StatusBadRequest},
+  }
+
+  for _, test := range tests {
+    req := httptest.NewRequest("GET", "/sign/?ref=" + b.Ref() + "&ttl=" + test.ttl, nil)
+    w := httptest.NewRecorder()
+    (&signHandler{bs: bs}).ServeHTTP(w, req)
+    if w.Code != test.want {
+      t.Errorf("ttl %q: got status %v, want %v", test.ttl, w.Code, test.want)
+    }
+  }
+}
@@ -2,30 +2,145 @@
 package blobserv
 
 import (
+  "os"
   "bytes"
+  "bufio"
+  "strings"
   "time"
   "strconv"
   "mime/multipart"
   "encoding/json"
+  "io"
   "io/ioutil"
   "net/http"
+  "crypto"
   "crypto/tls"
   "errors"
   "github.com/rwcarlsen/cas/blob"
+  "github.com/rwcarlsen/cas/auth"
   "github.com/rwcarlsen/cas/blobserv/timeindex"
   "github.com/rwcarlsen/cas/blobserv/objindex"
+  "github.com/rwcarlsen/cas/blobserv/typeindex"
+  "github.com/rwcarlsen/cas/blobserv/audit"
 )
 
+// PassEnv names the environment variable command line tools read a
+// blobserver password from if they aren't given a password file.
+// Passwords are never taken on the command line where other users could
+// see them with ps.
+const PassEnv = "RCAS_PASS"
+
+var (
+  BadAddrErr = errors.New("blobserv: address must be user@host (or keyid@host with a key file)")
+  NoPassErr = errors.New("blobserv: no password (set $" + PassEnv + " or use a password file)")
+  NoResultsErr = errors.New("blobserv: no blobs for that index query")
+)
+
+// NewClient returns a client for addr. Without a keyFile, addr is
+// user@host and the password is read from passFile (or $PassEnv if
+// passFile is empty). With one, addr is keyid@host. Addresses holding a
+// password (user:pass@host) are refused.
+func NewClient(addr, keyFile, passFile string) (*Client, error) {
+  tmp := strings.SplitN(addr, "@", 2)
+  if len(tmp) != 2 || tmp[0] == "" || tmp[1] == "" || strings.Contains(tmp[0], ":") {
+    return nil, BadAddrErr
+  }
+
+  c := &Client{Host: tmp[1]}
+  if keyFile != "" {
+    c.KeyID, c.KeyFile = tmp[0], keyFile
+    return c, nil
+  }
+
+  pass, err := ReadPass(passFile)
+  if err != nil {
+    return nil, err
+  }
+  c.User, c.Pass = tmp[0], pass
+  return c, nil
+}
+
+// ReadPass returns the password held in passFile or, if passFile is
+// empty, in $PassEnv.
+func ReadPass(passFile string) (string, error) {
+  if passFile == "" {
+    pass := os.Getenv(PassEnv)
+    if pass == "" {
+      return "", NoPassErr
+    }
+    return pass, nil
+  }
+
+  data, err := ioutil.ReadFile(passFile)
+  if err != nil {
+    return "", err
+  }
+  return strings.TrimRight(string(data), "\r\n"), nil
+}
+
 type Client struct {
   Host string
   User string
   Pass string
+  // Via and ViaPass authenticate requests through a share blob (and its
+  // password if it has one) instead of User and Pass. Content of files
+  // shared this way must be retrieved with ReconstituteFile.
+  Via string
+  ViaPass string
+  // KeyID and KeyFile sign requests with the private key in KeyFile
+  // (authorized on the server as KeyID) instead of sending User and Pass.
+  KeyID string
+  KeyFile string
+  key crypto.Signer
+}
+
+// SetKey makes c sign requests with key instead of loading one from
+// KeyFile.
+func (c *Client) SetKey(keyID string, key crypto.Signer) {
+  c.KeyID = keyID
+  c.key = key
 }
 
-func (c *Client) setAuth(r *http.Request) {
-  if c.User + c.Pass != "" {
+func (c *Client) setAuth(r *http.Request) error {
+  if c.Via != "" {
+    q := r.URL.Query()
+    q.Set("via", c.Via)
+    r.URL.RawQuery = q.Encode()
+    if c.ViaPass != "" {
+      r.Header.Set(SharePassField, c.ViaPass)
+    }
+  }
+
+  if c.KeyID != "" {
+    return c.sign(r)
+  } else if c.User + c.Pass != "" {
     r.SetBasicAuth(c.User, c.Pass)
   }
+  return nil
+}
+
+func (c *Client) sign(r *http.Request) error {
+  if c.key == nil {
+    key, err := auth.LoadPrivateKey(c.KeyFile)
+    if err != nil {
+      return err
+    }
+    c.key = key
+  }
+
+  body := []byte{}
+  if r.GetBody != nil {
+    rc, err := r.GetBody()
+    if err != nil {
+      return err
+    }
+    body, err = ioutil.ReadAll(rc)
+    rc.Close()
+    if err != nil {
+      return err
+    }
+  }
+  return auth.SignRequest(r, c.KeyID, c.key, body)
 }
 
 func (c *Client) GetBlob(ref string) (*blob.Blob, error) {
@@ -33,7 +148,7 @@ func (c *Client) GetBlob(ref string) (*blob.Blob, error) {
   if err != nil {
     return nil, err
   }
-  return blob.NewRaw(data), nil
+  return newBlobFor(ref, data), nil
 }
 
 func (c *Client) Dial() error {
@@ -46,13 +161,20 @@ func (c *Client) Dial() error {
   return err
 }
 
+// httpClient is shared by all Clients so connections are kept alive and
+// reused across requests.
+var httpClient = &http.Client{
+  Transport: &http.Transport{
+    // allows me to use encryption certificate that is not signed by a
+    // verified authority
+    TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+    Proxy: http.ProxyFromEnvironment,
+    MaxIdleConnsPerHost: 2 * DefaultParallel,
+  },
+}
+
 func getClient() *http.Client {
-  // allows me to use encryption certificate that is not signed by a
-  // verified authority
-  config := &tls.Config{InsecureSkipVerify: true}
-  return &http.Client{
-    Transport: &http.Transport{TLSClientConfig: config, Proxy: http.ProxyFromEnvironment},
-  }
+  return httpClient
 }
 
 func (c *Client) GetBlobContent(ref string) ([]byte, error) {
@@ -62,49 +184,131 @@ func (c *Client) GetBlobContent(ref string) ([]byte, error) {
   }
 
   r.URL.Path = "/ref/" + ref
-  c.setAuth(r)
+  if err := c.setAuth(r); err != nil {
+    return nil, err
+  }
 
   resp, err := getClient().Do(r)
   if err != nil {
     return nil, err
   }
 
-  status := resp.Header.Get(ActionStatus)
-  if status == ActionFailed {
-    return nil, errors.New("blobserv: blob retrieval failed")
+  defer resp.Body.Close()
+
+  if err := checkStatus(resp); err != nil {
+    return nil, err
   }
+  return ioutil.ReadAll(resp.Body)
+}
 
-  content, err := ioutil.ReadAll(resp.Body)
+// Has returns true if the blobserver has a blob for ref.
+func (c *Client) Has(ref string) (bool, error) {
+  r, err := http.NewRequest("HEAD", c.Host, nil)
   if err != nil {
-    return nil, err
+    return false, err
   }
 
+  r.URL.Path = "/ref/" + ref
+  if err := c.setAuth(r); err != nil {
+    return false, err
+  }
+
+  resp, err := getClient().Do(r)
+  if err != nil {
+    return false, err
+  }
   resp.Body.Close()
-  return content, nil
+
+  if resp.StatusCode == http.StatusNotFound {
+    return false, nil
+  } else if err := checkStatus(resp); err != nil {
+    return false, err
+  }
+  return true, nil
 }
 
-func (c *Client) ReconstituteFile(ref string) (m *blob.Meta, content []byte, err error) {
+// ReconstituteFile retrieves the meta blob identified by ref and writes the
+// file bytes it describes to w one content chunk at a time.
+func (c *Client) ReconstituteFile(ref string, w io.Writer) (m *blob.Meta, err error) {
   b, err := c.GetBlob(ref)
   if err != nil {
-    return nil, nil, err
+    return nil, err
   }
 
   m = &blob.Meta{}
   err = blob.Unmarshal(b, m)
   if err != nil {
-    return nil, nil, err
+    return nil, err
   }
 
-  chunks := []*blob.Blob{}
-  for _, ref := range m.ContentRefs {
-    b, err := c.GetBlob(ref)
-    if err != nil {
-      return nil, nil, err
+  if c.Via != "" {
+    // content blobs are only shared by way of their meta
+    viaMeta := *c
+    viaMeta.Via = strings.Split(c.Via, ",")[0] + "," + ref
+    return m, viaMeta.WriteContent(m, w)
+  }
+  return m, c.WriteContent(m, w)
+}
+
+// OpenFile requests the content of the file meta metaref from the
+// blobserver's /file/ endpoint. The Range, If-Range, If-None-Match and
+// If-Modified-Since headers of hdr (which may be nil) are passed along so
+// the response can be relayed as is. The caller must close the response
+// body.
+func (c *Client) OpenFile(metaref string, hdr http.Header) (*http.Response, error) {
+  r, err := http.NewRequest("GET", c.Host, nil)
+  if err != nil {
+    return nil, err
+  }
+
+  r.URL.Path = "/file/" + metaref
+  for _, k := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+    if v := hdr.Get(k); v != "" {
+      r.Header.Set(k, v)
+    }
+  }
+  if err := c.setAuth(r); err != nil {
+    return nil, err
+  }
+
+  resp, err := getClient().Do(r)
+  if err != nil {
+    return nil, err
+  }
+
+  switch resp.StatusCode {
+  case http.StatusNotModified, http.StatusRequestedRangeNotSatisfiable:
+  default:
+    if err := checkStatus(resp); err != nil {
+      resp.Body.Close()
+      return nil, err
     }
-    chunks = append(chunks, b)
   }
+  return resp, nil
+}
 
-  return m, blob.Reconstitute(chunks...), nil
+// WriteContent retrieves the ContentRefs of m in order and writes their
+// bytes to w. Only a small window of chunks is held in memory at a time.
+func (c *Client) WriteContent(m *blob.Meta, w io.Writer) error {
+  // fetch a few chunks per parallel request at a time to bound memory use
+  window := 4 * DefaultParallel
+  for start := 0; start < len(m.ContentRefs); start += window {
+    end := start + window
+    if end > len(m.ContentRefs) {
+      end = len(m.ContentRefs)
+    }
+
+    blobs, err := c.GetBlobs(m.ContentRefs[start:end]...)
+    if err != nil {
+      return err
+    }
+    for _, b := range blobs {
+      if _, err := w.Write(b.Content()); err != nil {
+        return err
+      }
+    }
+  }
+  return nil
 }
 
 func (c *Client) PutBlob(b *blob.Blob) error {
@@ -114,17 +318,21 @@ func (c *Client) PutBlob(b *blob.Blob) error {
   }
 
   r.URL.Path = "/put/"
-  c.setAuth(r)
+  r.Header.Set(RefField, b.Ref())
+  if err := c.setAuth(r); err != nil {
+    return err
+  }
   resp, err := getClient().Do(r)
   if err != nil {
     return err
   }
+  resp.Body.Close()
 
-  status := resp.Header.Get(ActionStatus)
-  if status == ActionFailed {
-    return errors.New("blobserv: blob posting failed")
+  if err := checkStatus(resp); err != nil {
+    return err
+  } else if ref := resp.Header.Get(RefField); ref != "" && ref != b.Ref() {
+    return RefMismatchErr
   }
-
   return nil
 }
 
@@ -142,12 +350,19 @@ func (c *Client) IndexBlobs(name string, nBlobs int, params interface{}) ([]*blo
   r.URL.Path = "/index/"
   r.Header.Set(IndexField, name)
   r.Header.Set(ResultCountField, strconv.Itoa(nBlobs))
-  c.setAuth(r)
+  if err := c.setAuth(r); err != nil {
+    return nil, err
+  }
 
   resp, err := getClient().Do(r)
   if err != nil {
     return nil, err
   }
+  defer resp.Body.Close()
+
+  if err := checkStatus(resp); err != nil {
+    return nil, err
+  }
 
   boundary := resp.Header.Get(BoundaryField)
   mr := multipart.NewReader(resp.Body, boundary)
@@ -172,7 +387,7 @@ func (c *Client) IndexBlobs(name string, nBlobs int, params interface{}) ([]*blo
 	}
 
   if len(blobs) == 0 {
-    return nil, errors.New("blobserv: no blobs for that index query")
+    return nil, NoResultsErr
   }
 
   return blobs, nil
@@ -196,6 +411,28 @@ func (c *Client) BlobsForward(t time.Time, n, nskip int) ([]*blob.Blob, error) {
   return c.IndexBlobs("time", n, &indReq)
 }
 
+// BlobsOfType returns up to n blobs of RcasType typ, oldest first, after
+// skipping the nskip oldest.
+func (c *Client) BlobsOfType(typ string, n, nskip int) ([]*blob.Blob, error) {
+  indReq := typeindex.Request{
+    Type: typ,
+    Dir: typeindex.Forward,
+    SkipN: nskip,
+  }
+  return c.IndexBlobs("type", n, &indReq)
+}
+
+// NewestOfType returns up to n blobs of RcasType typ, newest first, after
+// skipping the nskip newest.
+func (c *Client) NewestOfType(typ string, n, nskip int) ([]*blob.Blob, error) {
+  indReq := typeindex.Request{
+    Type: typ,
+    Dir: typeindex.Backward,
+    SkipN: nskip,
+  }
+  return c.IndexBlobs("type", n, &indReq)
+}
+
 func (c *Client) ObjectTip(objref string) (*blob.Blob, error) {
   objReq := objindex.Request{ObjectRef:objref}
   blobs, err := c.IndexBlobs("object", 1, objReq)
@@ -205,3 +442,250 @@ func (c *Client) ObjectTip(objref string) (*blob.Blob, error) {
   return blobs[0], nil
 }
 
+
+// PrunableVersions returns up to n versions of object objref that are not
+// retained by its retention policy. An empty objref returns prunable
+// versions of every object.
+func (c *Client) PrunableVersions(objref string, n int) ([]*blob.Blob, error) {
+  objReq := objindex.Request{ObjectRef: objref, Prunable: true}
+  return c.IndexBlobs("object", n, objReq)
+}
+
+// SetRetention assigns a retention policy to object objref.
+func (c *Client) SetRetention(objref string, p *objindex.Policy) error {
+  b, err := blob.Marshal(objindex.NewPolicyBlob(objref, p))
+  if err != nil {
+    return err
+  }
+  return c.PutBlob(b)
+}
+
+// Revoke permanently disables the share blob shareRef.
+func (c *Client) Revoke(shareRef string) error {
+  b, err := blob.Marshal(blob.NewRevocation(shareRef))
+  if err != nil {
+    return err
+  }
+  return c.PutBlob(b)
+}
+
+// SignURL asks the server for a url that retrieves ref without
+// authentication for ttl. If objref is not empty, the url's parameters
+// also work for any version of object objref and its versions' content
+// blobs (ref may then be empty to link to objref itself).
+func (c *Client) SignURL(ref, objref string, ttl time.Duration) (string, error) {
+  r, err := http.NewRequest("GET", c.Host, nil)
+  if err != nil {
+    return "", err
+  }
+
+  r.URL.Path = "/sign/"
+  q := r.URL.Query()
+  q.Set("ref", ref)
+  q.Set("obj", objref)
+  q.Set("ttl", ttl.String())
+  r.URL.RawQuery = q.Encode()
+  if err := c.setAuth(r); err != nil {
+    return "", err
+  }
+
+  resp, err := getClient().Do(r)
+  if err != nil {
+    return "", err
+  }
+  defer resp.Body.Close()
+
+  if err := checkStatus(resp); err != nil {
+    return "", err
+  }
+
+  pth, err := ioutil.ReadAll(resp.Body)
+  if err != nil {
+    return "", err
+  }
+  return c.Host + string(pth), nil
+}
+
+// Audit returns the server's audit log entries matching q, newest first.
+// It requires admin credentials.
+func (c *Client) Audit(q *audit.Request) ([]*audit.Entry, error) {
+  data, err := json.Marshal(q)
+  if err != nil {
+    return nil, err
+  }
+
+  r, err := http.NewRequest("POST", c.Host, bytes.NewBuffer(data))
+  if err != nil {
+    return nil, err
+  }
+
+  r.URL.Path = "/audit/"
+  if err := c.setAuth(r); err != nil {
+    return nil, err
+  }
+
+  resp, err := getClient().Do(r)
+  if err != nil {
+    return nil, err
+  }
+  defer resp.Body.Close()
+
+  if err := checkStatus(resp); err != nil {
+    return nil, err
+  }
+
+  entries := []*audit.Entry{}
+  if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+    return nil, err
+  }
+  return entries, nil
+}
+
+// Enumerator pages through every ref on a blobserver in sorted order (see
+// Client.Enumerate).
+type Enumerator struct {
+  // Sizes requests each blob's size along with its ref.
+  Sizes bool
+  // PageSize is the number of refs requested at a time. Zero uses the
+  // server's default.
+  PageSize int
+  c *Client
+  cursor string
+  page []*BlobStat
+  last bool
+}
+
+// Enumerate returns an Enumerator starting after the ref cursor names. An
+// empty cursor starts from the first ref.
+func (c *Client) Enumerate(cursor string) *Enumerator {
+  return &Enumerator{c: c, cursor: cursor}
+}
+
+// Next returns the next ref (and its size if Sizes is set). It returns
+// EnumEndErr once every ref has been listed.
+func (e *Enumerator) Next() (*BlobStat, error) {
+  if len(e.page) == 0 {
+    if e.last {
+      return nil, EnumEndErr
+    }
+    if err := e.fetch(); err != nil {
+      return nil, err
+    } else if len(e.page) == 0 {
+      return nil, EnumEndErr
+    }
+  }
+
+  st := e.page[0]
+  e.page = e.page[1:]
+  e.cursor = encodeCursor(st.Ref)
+  return st, nil
+}
+
+// Cursor returns a cursor that resumes enumeration after the last ref
+// returned by Next.
+func (e *Enumerator) Cursor() string {
+  return e.cursor
+}
+
+func (e *Enumerator) fetch() error {
+  r, err := http.NewRequest("GET", e.c.Host, nil)
+  if err != nil {
+    return err
+  }
+
+  r.URL.Path = "/enumerate/"
+  v := r.URL.Query()
+  v.Set("after", e.cursor)
+  if e.PageSize > 0 {
+    v.Set("max", strconv.Itoa(e.PageSize))
+  }
+  if e.Sizes {
+    v.Set("sizes", "true")
+  }
+  r.URL.RawQuery = v.Encode()
+  if err := e.c.setAuth(r); err != nil {
+    return err
+  }
+
+  resp, err := getClient().Do(r)
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+
+  if err := checkStatus(resp); err != nil {
+    return err
+  }
+
+  page := &EnumPage{}
+  if err := json.NewDecoder(resp.Body).Decode(page); err != nil {
+    return err
+  }
+  e.page, e.last = page.Blobs, page.Next == ""
+  return nil
+}
+
+// Subscribe streams the refs of blobs stored on the blobserver from now on
+// through the returned channel. Non-empty typ and objref restrict the
+// stream to blobs of that RcasType or belonging to that object. The
+// channel is closed when stop is closed or the stream ends (e.g. because
+// the server dropped a subscriber that fell too far behind); callers that
+// must not miss blobs should then catch up with the time index or
+// Enumerate and subscribe again.
+func (c *Client) Subscribe(typ, objref string, stop <-chan bool) (<-chan string, error) {
+  r, err := http.NewRequest("GET", c.Host, nil)
+  if err != nil {
+    return nil, err
+  }
+
+  r.URL.Path = "/subscribe/"
+  v := r.URL.Query()
+  if typ != "" {
+    v.Set("type", typ)
+  }
+  if objref != "" {
+    v.Set("obj", objref)
+  }
+  r.URL.RawQuery = v.Encode()
+  if err := c.setAuth(r); err != nil {
+    return nil, err
+  }
+
+  resp, err := getClient().Do(r)
+  if err != nil {
+    return nil, err
+  }
+  if err := checkStatus(resp); err != nil {
+    resp.Body.Close()
+    return nil, err
+  }
+
+  refs := make(chan string)
+  done := make(chan bool)
+  go func() {
+    select {
+    case <-stop:
+    case <-done:
+    }
+    resp.Body.Close()
+  }()
+
+  go func() {
+    defer close(refs)
+    defer close(done)
+
+    scan := bufio.NewScanner(resp.Body)
+    for scan.Scan() {
+      line := scan.Text()
+      if !strings.HasPrefix(line, "data: ") {
+        continue
+      }
+      select {
+      case refs <- strings.TrimPrefix(line, "data: "):
+      case <-stop:
+        return
+      }
+    }
+  }()
+  return refs, nil
+}
@@ -0,0 +1,368 @@
+package blobserv
+
+import (
+  "bytes"
+  "sync"
+  "strings"
+  "strconv"
+  "net/http"
+  "io/ioutil"
+  "encoding/json"
+  "mime/multipart"
+  "github.com/rwcarlsen/cas/blob"
+)
+
+// Limits used by PutBlobs, GetBlobs and Uploader.
+const (
+  DefaultBatchSize = 64 // max blobs per request
+  DefaultBatchBytes = 16 << 20 // 16 Mb of content per batch put
+  DefaultParallel = 4 // max concurrent requests
+)
+
+// newBlobFor creates a blob for data retrieved under ref.
+func newBlobFor(ref string, data []byte) *blob.Blob {
+  b := blob.NewRaw(data)
+  if h, _, err := blob.ParseRef(ref); err == nil {
+    b.Hash = h
+  }
+  return b
+}
+
+// Uploader stores blobs passed to Put in batches, running up to
+// DefaultParallel batch puts at a time in the background. Close must be
+// called to send the last batch.
+type Uploader struct {
+  // SkipExisting makes the Uploader check which blobs of each batch the
+  // blobserver already has and only send the missing ones.
+  SkipExisting bool
+  c *Client
+  pending []*blob.Blob
+  size int
+  sem chan bool
+  wg sync.WaitGroup
+  lock sync.Mutex
+  err error
+}
+
+func (c *Client) NewUploader() *Uploader {
+  return &Uploader{c: c, sem: make(chan bool, DefaultParallel)}
+}
+
+// Put queues b for storage. It returns the first error of any batch sent
+// so far.
+func (u *Uploader) Put(b *blob.Blob) error {
+  u.pending = append(u.pending, b)
+  u.size += len(b.Content())
+  if len(u.pending) >= DefaultBatchSize || u.size >= DefaultBatchBytes {
+    u.flush()
+  }
+  return u.Err()
+}
+
+// Err returns the first error of any batch sent so far.
+func (u *Uploader) Err() error {
+  u.lock.Lock()
+  defer u.lock.Unlock()
+  return u.err
+}
+
+func (u *Uploader) flush() {
+  if len(u.pending) == 0 {
+    return
+  }
+
+  batch := u.pending
+  u.pending, u.size = nil, 0
+
+  u.sem <- true
+  u.wg.Add(1)
+  go func() {
+    defer u.wg.Done()
+    var err error
+    if u.SkipExisting {
+      batch, err = u.c.missing(batch)
+    }
+    if err == nil && len(batch) > 0 {
+      err = u.c.putBatch(batch)
+    }
+    <-u.sem
+
+    u.lock.Lock()
+    if u.err == nil {
+      u.err = err
+    }
+    u.lock.Unlock()
+  }()
+}
+
+// Close sends any queued blobs and waits for all batches to finish.
+func (u *Uploader) Close() error {
+  u.flush()
+  u.wg.Wait()
+  return u.Err()
+}
+
+// PutBlobs stores blobs using as few requests as possible.
+func (c *Client) PutBlobs(blobs ...*blob.Blob) error {
+  u := c.NewUploader()
+  for _, b := range blobs {
+    if err := u.Put(b); err != nil {
+      u.Close()
+      return err
+    }
+  }
+  return u.Close()
+}
+
+// missing returns the blobs the blobserver doesn't have yet.
+func (c *Client) missing(blobs []*blob.Blob) ([]*blob.Blob, error) {
+  if c.Via != "" {
+    // stats can't be authorized through shares
+    return blobs, nil
+  }
+
+  stats, err := c.StatBlobs(blob.RefsFor(blobs)...)
+  if err != nil {
+    return nil, err
+  }
+
+  need := []*blob.Blob{}
+  for i, st := range stats {
+    if !st.Exists {
+      need = append(need, blobs[i])
+    }
+  }
+  return need, nil
+}
+
+// StatBlobs reports the existence and size of each of refs (in the same
+// order).
+func (c *Client) StatBlobs(refs ...string) ([]*BlobStat, error) {
+  stats := []*BlobStat{}
+  for start := 0; start < len(refs); start += MaxBatch {
+    end := start + MaxBatch
+    if end > len(refs) {
+      end = len(refs)
+    }
+
+    batch, err := c.statBatch(refs[start:end])
+    if err != nil {
+      return nil, err
+    }
+    stats = append(stats, batch...)
+  }
+  return stats, nil
+}
+
+func (c *Client) statBatch(refs []string) ([]*BlobStat, error) {
+  r, err := http.NewRequest("POST", c.Host, strings.NewReader(strings.Join(refs, "\n")))
+  if err != nil {
+    return nil, err
+  }
+  r.URL.Path = "/stat/"
+  r.Header.Set("Content-Type", "text/plain")
+  if err := c.setAuth(r); err != nil {
+    return nil, err
+  }
+
+  resp, err := getClient().Do(r)
+  if err != nil {
+    return nil, err
+  }
+  defer resp.Body.Close()
+
+  if err := checkStatus(resp); err != nil {
+    return nil, err
+  }
+
+  stats := []*BlobStat{}
+  if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+    return nil, err
+  } else if len(stats) != len(refs) {
+    return nil, ServerErr
+  }
+  for i, st := range stats {
+    if st.Ref != refs[i] {
+      return nil, ServerErr
+    }
+  }
+  return stats, nil
+}
+
+func (c *Client) putBatch(blobs []*blob.Blob) error {
+  if c.Via != "" {
+    // batches can't be authorized through shares
+    for _, b := range blobs {
+      if err := c.PutBlob(b); err != nil {
+        return err
+      }
+    }
+    return nil
+  }
+
+  var body bytes.Buffer
+  mw := multipart.NewWriter(&body)
+  for _, b := range blobs {
+    part, err := mw.CreateFormFile("blob", b.Ref())
+    if err != nil {
+      return err
+    }
+    part.Write(b.Content())
+  }
+  if err := mw.Close(); err != nil {
+    return err
+  }
+
+  r, err := http.NewRequest("POST", c.Host, &body)
+  if err != nil {
+    return err
+  }
+  r.URL.Path = "/put/"
+  r.Header.Set("Content-Type", mw.FormDataContentType())
+  if err := c.setAuth(r); err != nil {
+    return err
+  }
+
+  resp, err := getClient().Do(r)
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+
+  if err := checkStatus(resp); err != nil {
+    return err
+  }
+
+  results := []*PutResult{}
+  if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+    return err
+  } else if len(results) != len(blobs) {
+    return ServerErr
+  }
+
+  for i, res := range results {
+    if err := errForStatus(res.Status); err != nil {
+      return err
+    } else if res.Ref != blobs[i].Ref() {
+      return RefMismatchErr
+    }
+  }
+  return nil
+}
+
+// GetBlobs retrieves the blobs for refs (in the same order) using up to
+// DefaultParallel concurrent batch requests.
+func (c *Client) GetBlobs(refs ...string) ([]*blob.Blob, error) {
+  blobs := make([]*blob.Blob, len(refs))
+  if c.Via != "" {
+    // batches can't be authorized through shares
+    for i, ref := range refs {
+      b, err := c.GetBlob(ref)
+      if err != nil {
+        return nil, err
+      }
+      blobs[i] = b
+    }
+    return blobs, nil
+  }
+
+  per := (len(refs) + DefaultParallel - 1) / DefaultParallel
+  if per > DefaultBatchSize {
+    per = DefaultBatchSize
+  } else if per < 1 {
+    per = 1
+  }
+
+  var wg sync.WaitGroup
+  var lock sync.Mutex
+  var firstErr error
+  sem := make(chan bool, DefaultParallel)
+  for start := 0; start < len(refs); start += per {
+    end := start + per
+    if end > len(refs) {
+      end = len(refs)
+    }
+
+    sem <- true
+    wg.Add(1)
+    go func(start, end int) {
+      defer wg.Done()
+      err := c.getBatch(refs[start:end], blobs[start:end])
+      <-sem
+
+      lock.Lock()
+      if firstErr == nil {
+        firstErr = err
+      }
+      lock.Unlock()
+    }(start, end)
+  }
+  wg.Wait()
+
+  if firstErr != nil {
+    return nil, firstErr
+  }
+  return blobs, nil
+}
+
+// getBatch retrieves refs in a single request storing them in blobs.
+func (c *Client) getBatch(refs []string, blobs []*blob.Blob) error {
+  r, err := http.NewRequest("POST", c.Host, strings.NewReader(strings.Join(refs, "\n")))
+  if err != nil {
+    return err
+  }
+  r.URL.Path = "/ref/"
+  r.Header.Set("Content-Type", "text/plain")
+  if err := c.setAuth(r); err != nil {
+    return err
+  }
+
+  resp, err := getClient().Do(r)
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+
+  if err := checkStatus(resp); err != nil {
+    return err
+  }
+
+  index := map[string][]int{}
+  for i, ref := range refs {
+    index[ref] = append(index[ref], i)
+  }
+
+  mr := multipart.NewReader(resp.Body, resp.Header.Get(BoundaryField))
+  for {
+    part, err := mr.NextPart()
+    if err != nil {
+      break
+    }
+
+    status, _ := strconv.Atoi(part.Header.Get(StatusField))
+    if err := errForStatus(status); err != nil {
+      return err
+    }
+
+    data, err := ioutil.ReadAll(part)
+    if err != nil {
+      return err
+    }
+
+    ref := part.FileName()
+    b := newBlobFor(ref, data)
+    if b.Ref() != ref {
+      return RefMismatchErr
+    }
+    for _, i := range index[ref] {
+      blobs[i] = b
+    }
+  }
+
+  for _, b := range blobs {
+    if b == nil {
+      return ServerErr
+    }
+  }
+  return nil
+}
@@ -0,0 +1,97 @@
+package blobserv
+
+import (
+  "fmt"
+  "errors"
+  "strconv"
+  "net/http"
+  "encoding/json"
+  "encoding/base64"
+)
+
+// Page sizes for /enumerate/.
+const (
+  DefaultEnumerate = 1000
+  MaxEnumerate = 10000
+)
+
+var (
+  EnumEndErr = errors.New("blobserv: end of enumeration")
+  BadCursorErr = errors.New("blobserv: malformed enumeration cursor")
+)
+
+// EnumPage is one page of refs from /enumerate/.
+type EnumPage struct {
+  Blobs []*BlobStat
+  // Next is the cursor to pass as "after" for the following page. It is
+  // empty once every ref has been listed.
+  Next string `json:",omitempty"`
+}
+
+func encodeCursor(ref string) string {
+  return base64.RawURLEncoding.EncodeToString([]byte(ref))
+}
+
+func decodeCursor(cursor string) (string, error) {
+  ref, err := base64.RawURLEncoding.DecodeString(cursor)
+  if err != nil {
+    return "", BadCursorErr
+  }
+  return string(ref), nil
+}
+
+// enumerateHandler pages through every ref in the store in sorted order.
+// The "after" form value is a cursor from a previous page, "max" limits
+// the page size and "sizes" set to true includes each blob's size.
+type enumerateHandler struct {
+  bs *Server
+}
+
+func (h *enumerateHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+  defer func() {
+    if r := recover(); r != nil {
+      sendErr(w, r)
+      fmt.Println("blob enumeration failed: ", r)
+    }
+  }()
+
+  after, err := decodeCursor(req.FormValue("after"))
+  if err != nil {
+    panic(BadRequestErr)
+  }
+
+  max := DefaultEnumerate
+  if s := req.FormValue("max"); s != "" {
+    if max, err = strconv.Atoi(s); err != nil || max < 1 {
+      panic(BadRequestErr)
+    }
+  }
+  if max > MaxEnumerate {
+    max = MaxEnumerate
+  }
+  sizes := req.FormValue("sizes") == "true"
+
+  page := &EnumPage{Blobs: []*BlobStat{}}
+  refs := h.bs.Db.List(after, max)
+  for _, ref := range refs {
+    st := &BlobStat{Ref: ref, Exists: true}
+    if sizes {
+      st.Size, _ = h.bs.Db.Stat(ref)
+    }
+    page.Blobs = append(page.Blobs, st)
+  }
+  if len(refs) == max {
+    page.Next = encodeCursor(refs[len(refs) - 1])
+  }
+
+  data, err := json.Marshal(page)
+  if err != nil {
+    panic(err)
+  }
+  w.Header().Set(ActionStatus, ActionSuccess)
+  w.Write(data)
+}
+
+func (h *enumerateHandler) Unauthorized(w http.ResponseWriter, req *http.Request) {
+  deny(w, req)
+}
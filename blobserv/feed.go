@@ -0,0 +1,133 @@
+package blobserv
+
+import (
+  "fmt"
+  "sync"
+  "time"
+  "net/http"
+  "github.com/rwcarlsen/cas/blob"
+)
+
+const (
+  // feedBuffer is how many refs a subscriber may fall behind by before
+  // its stream is ended.
+  feedBuffer = 256
+  // feedPing is how often an idle stream is sent a comment to keep the
+  // connection open.
+  feedPing = 30 * time.Second
+)
+
+// subscriber receives the refs of new blobs matching its filters.
+type subscriber struct {
+  typ string
+  objref string
+  refs chan string
+}
+
+func (s *subscriber) wants(b *blob.Blob) bool {
+  if s.typ != "" && b.Type() != s.typ {
+    return false
+  } else if s.objref != "" && b.Ref() != s.objref && b.ObjectRef() != s.objref {
+    return false
+  }
+  return true
+}
+
+// feed passes newly stored blobs to subscribers.
+type feed struct {
+  subs map[*subscriber]bool
+  lock sync.Mutex
+}
+
+func (f *feed) subscribe(typ, objref string) *subscriber {
+  f.lock.Lock()
+  defer f.lock.Unlock()
+
+  if f.subs == nil {
+    f.subs = map[*subscriber]bool{}
+  }
+  s := &subscriber{typ: typ, objref: objref, refs: make(chan string, feedBuffer)}
+  f.subs[s] = true
+  return s
+}
+
+func (f *feed) unsubscribe(s *subscriber) {
+  f.lock.Lock()
+  defer f.lock.Unlock()
+
+  if f.subs[s] {
+    delete(f.subs, s)
+    close(s.refs)
+  }
+}
+
+// publish never blocks - subscribers that have fallen too far behind are
+// dropped (their refs channel is closed) so they know to catch up some
+// other way.
+func (f *feed) publish(blobs ...*blob.Blob) {
+  f.lock.Lock()
+  defer f.lock.Unlock()
+
+  for s := range f.subs {
+    for _, b := range blobs {
+      if !s.wants(b) {
+        continue
+      }
+      select {
+      case s.refs <- b.Ref():
+      default:
+        delete(f.subs, s)
+        close(s.refs)
+      }
+      if !f.subs[s] {
+        break
+      }
+    }
+  }
+}
+
+// subscribeHandler streams the refs of blobs as they are stored as
+// server-sent events. The "type" and "obj" form values restrict the
+// stream to blobs of that RcasType or belonging to that object. The
+// stream ends if the client falls too far behind.
+type subscribeHandler struct {
+  bs *Server
+}
+
+func (h *subscribeHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+  s := h.bs.feed.subscribe(req.FormValue("type"), req.FormValue("obj"))
+  defer h.bs.feed.unsubscribe(s)
+
+  // the stream outlives the server's write timeout
+  rc := http.NewResponseController(w)
+  rc.SetWriteDeadline(time.Time{})
+
+  w.Header().Set("Content-Type", "text/event-stream")
+  w.Header().Set("Cache-Control", "no-cache")
+  w.Header().Set(ActionStatus, ActionSuccess)
+  w.WriteHeader(http.StatusOK)
+  rc.Flush()
+
+  ping := time.NewTicker(feedPing)
+  defer ping.Stop()
+  for {
+    select {
+    case ref, ok := <-s.refs:
+      if !ok {
+        return
+      }
+      fmt.Fprintf(w, "id: %v\ndata: %v\n\n", ref, ref)
+    case <-ping.C:
+      fmt.Fprint(w, ": ping\n\n")
+    case <-req.Context().Done():
+      return
+    }
+    if err := rc.Flush(); err != nil {
+      return
+    }
+  }
+}
+
+func (h *subscribeHandler) Unauthorized(w http.ResponseWriter, req *http.Request) {
+  deny(w, req)
+}
@@ -0,0 +1,195 @@
+package blobserv
+
+import (
+  "io"
+  "fmt"
+  "sort"
+  "path"
+  "time"
+  "errors"
+  "net/http"
+  "github.com/rwcarlsen/cas/blob"
+  "github.com/rwcarlsen/cas/util"
+  "github.com/rwcarlsen/cas/blobdb"
+  "github.com/rwcarlsen/cas/blobserv/audit"
+)
+
+var BadSeekErr = errors.New("blobserv: seek to negative file offset")
+
+// chunkReader reads and seeks through the bytes of a file meta's content
+// blobs holding only one chunk in memory at a time.
+type chunkReader struct {
+  db *blobdb.Dbase
+  refs []string
+  offsets []int64 // offsets[i] is where chunk i starts; the last is the size
+  pos int64
+  cur int // index of the chunk in data
+  data []byte
+}
+
+// newChunkReader stats the content refs of m to learn where each chunk
+// starts without retrieving them.
+func newChunkReader(db *blobdb.Dbase, m *blob.Meta) (*chunkReader, error) {
+  r := &chunkReader{db: db, refs: m.ContentRefs, offsets: []int64{0}, cur: -1}
+  for _, ref := range m.ContentRefs {
+    size, err := db.Stat(ref)
+    if err != nil {
+      return nil, NotFoundErr
+    }
+    r.offsets = append(r.offsets, r.Size() + size)
+  }
+  return r, nil
+}
+
+// Size returns the number of bytes in the file.
+func (r *chunkReader) Size() int64 {
+  return r.offsets[len(r.offsets) - 1]
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+  if r.pos >= r.Size() {
+    return 0, io.EOF
+  }
+
+  i := sort.Search(len(r.refs), func(i int) bool { return r.offsets[i + 1] > r.pos })
+  if i != r.cur {
+    b, err := r.db.Get(r.refs[i])
+    if err != nil {
+      return 0, err
+    } else if int64(len(b.Content())) != r.offsets[i + 1] - r.offsets[i] {
+      return 0, ServerErr
+    }
+    r.cur, r.data = i, b.Content()
+  }
+
+  n := copy(p, r.data[r.pos - r.offsets[i]:])
+  r.pos += int64(n)
+  return n, nil
+}
+
+func (r *chunkReader) Seek(offset int64, whence int) (int64, error) {
+  switch whence {
+  case io.SeekCurrent:
+    offset += r.pos
+  case io.SeekEnd:
+    offset += r.Size()
+  }
+  if offset < 0 {
+    return r.pos, BadSeekErr
+  }
+  r.pos = offset
+  return r.pos, nil
+}
+
+// countWriter counts the body bytes written to a response.
+type countWriter struct {
+  http.ResponseWriter
+  n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+  n, err := w.ResponseWriter.Write(p)
+  w.n += int64(n)
+  return n, err
+}
+
+// fileHandler streams the content of the file meta at /file/<metaref>
+// supporting Range, If-Range and ETag requests. Metas are immutable, so
+// the ref is the ETag.
+type fileHandler struct {
+  bs *Server
+}
+
+func (h *fileHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+  ref := path.Base(req.URL.Path)
+  e := &audit.Entry{Op: audit.Get, Ref: ref, Result: audit.Failed}
+  defer h.bs.record(req, e)
+  defer func() {
+    if r := recover(); r != nil {
+      sendErr(w, r)
+      fmt.Println("file get failed: ", r)
+    }
+  }()
+
+  b, err := h.bs.Db.Get(ref)
+  util.Check(err)
+  h.serve(w, req, b, e)
+}
+
+func (h *fileHandler) serve(w http.ResponseWriter, req *http.Request, b *blob.Blob, e *audit.Entry) {
+  m := &blob.Meta{}
+  if err := blob.Unmarshal(b, m); err != nil {
+    panic(BadRequestErr)
+  }
+
+  r, err := newChunkReader(h.bs.Db, m)
+  util.Check(err)
+
+  mod, _ := h.bs.Db.ModTime(b.Ref())
+  if mod.IsZero() {
+    mod = time.Unix(0, 0)
+  }
+
+  // large files outlive the server's write timeout
+  http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+  cw := &countWriter{ResponseWriter: w}
+  w.Header().Set("ETag", `"` + b.Ref() + `"`)
+  w.Header().Set(ActionStatus, ActionSuccess)
+  http.ServeContent(cw, req, m.Name, mod, r)
+  e.Bytes, e.Result = cw.n, audit.Ok
+}
+
+// Unauthorized serves files whose meta is retrievable through a
+// capability url (using the same parameters as for /ref/<metaref>) or a
+// share.
+func (h *fileHandler) Unauthorized(w http.ResponseWriter, req *http.Request) {
+  ref := path.Base(req.URL.Path)
+  e := &audit.Entry{Op: audit.Get, Ref: ref, Result: audit.Failed}
+  defer h.bs.record(req, e)
+  defer func() {
+    if r := recover(); r != nil {
+      sendErr(w, r)
+      fmt.Println("file get failed: ", r)
+    }
+  }()
+
+  // the content refs of metas stored through shares can't be trusted
+  if h.bs.shares.SharedPut(ref) {
+    e.Result = audit.Denied
+    deny(w, req)
+    return
+  }
+
+  if req.FormValue("sig") != "" {
+    e.Capability = true
+    b, err := h.bs.Db.Get(ref)
+    if err != nil || !h.bs.capAllows(req, b) {
+      e.Result = audit.Denied
+      deny(w, req)
+      return
+    }
+
+    h.serve(w, req, b, e)
+    return
+  }
+
+  shareRef, share, err := h.bs.viaShare(req)
+  e.Share = shareRef
+  if err != nil {
+    e.Result = audit.Denied
+    deny(w, req)
+    return
+  }
+
+  b, err := h.bs.Db.Get(ref)
+  util.Check(err)
+
+  if !h.bs.shareGet(req, shareRef, share, b) {
+    e.Result = audit.Denied
+    deny(w, req)
+    return
+  }
+
+  h.serve(w, req, b, e)
+}
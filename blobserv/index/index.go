@@ -2,6 +2,7 @@
 package index
 
 import (
+  "io"
   "errors"
   "net/http"
   "github.com/rwcarlsen/cas/blob"
@@ -16,6 +17,21 @@ type Index interface {
   GetIter(r *http.Request) (Iter, error)
 }
 
+// Persistent is implemented by indexes that can save their state and
+// restore it later instead of being rebuilt from every blob.
+type Persistent interface {
+  Index
+  Save(w io.Writer) error
+  Load(r io.Reader) error
+}
+
+// Sorter is implemented by indexes that must be sorted after being notified
+// of blobs in non-chronological order (e.g. when built by walking a
+// database).
+type Sorter interface {
+  Sort()
+}
+
 // Iter is used to walk through blob refs of an index.  
 //
 // When there are no more blobs to iterate over, Next returns an empty string
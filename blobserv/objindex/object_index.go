@@ -2,6 +2,8 @@
 package objindex
 
 import (
+  "io"
+  "encoding/gob"
   "encoding/json"
   "io/ioutil"
   "time"
@@ -14,14 +16,21 @@ import (
   "github.com/rwcarlsen/cas/blobserv/index"
 )
 
+// Request describes an object index query. Versions are returned newest
+// first. If Prunable is true, only versions not retained by the object's
+// retention policy are returned and an empty ObjectRef matches every object.
 type Request struct {
   ObjectRef string
   SkipN int
+  Prunable bool
 }
 
 type object struct {
   versions []string
   tms []time.Time
+  policy *Policy
+  policyTm time.Time
+  content map[string]bool // content refs of file meta versions
 }
 
 func (o *object) Add(b *blob.Blob) {
@@ -29,10 +38,22 @@ func (o *object) Add(b *blob.Blob) {
   t, err := b.Timestamp()
   util.Check(err)
   o.tms = append(o.tms, t)
+
+  m := &blob.Meta{}
+  if b.Type() != blob.MetaType || blob.Unmarshal(b, m) != nil {
+    return
+  }
+  if o.content == nil {
+    o.content = map[string]bool{}
+  }
+  for _, ref := range m.ContentRefs {
+    o.content[ref] = true
+  }
 }
 
 func (o *object) Swap(i, j int) {
   o.versions[i], o.versions[j] = o.versions[j], o.versions[i]
+  o.tms[i], o.tms[j] = o.tms[j], o.tms[i]
 }
 
 func (o *object) Less(i, j int) bool {
@@ -49,6 +70,9 @@ func (o *object) At(i int) string {
 
 type ObjectIndex struct {
   objs map[string]*object
+  // DefaultPolicy applies to objects with no policy blob of their own. Nil
+  // retains every version.
+  DefaultPolicy *Policy
   lock sync.RWMutex
 }
 
@@ -59,7 +83,7 @@ func New() *ObjectIndex {
 }
 
 // Notify adds additional blob refs to the object index if they have an
-// object ref.
+// object ref. Policy blobs set the retention policy of their target object.
 //
 //Blobs larger than MaxBlobSize and non-json encoded blobs are ignored
 // by TimeIndex
@@ -68,17 +92,73 @@ func (ind *ObjectIndex) Notify(blobs ...*blob.Blob) {
   defer ind.lock.Unlock()
 
   for _, b := range blobs {
+    if isPolicy(b) {
+      ind.setPolicy(b)
+      continue
+    }
+
     oref := b.ObjectRef()
     if oref == "" {
       continue
     }
 
-    if ind.objs[oref] == nil {
-      ind.objs[oref] = &object{}
-    }
+    ind.obj(oref).Add(b)
+  }
+}
 
-    ind.objs[oref].Add(b)
+func (ind *ObjectIndex) obj(oref string) *object {
+  if ind.objs[oref] == nil {
+    ind.objs[oref] = &object{}
   }
+  return ind.objs[oref]
+}
+
+func (ind *ObjectIndex) setPolicy(b *blob.Blob) {
+  pb := &PolicyBlob{}
+  if err := blob.Unmarshal(b, pb); err != nil || pb.TargetObject == "" {
+    return
+  }
+  t, err := b.Timestamp()
+  if err != nil {
+    return
+  }
+
+  o := ind.obj(pb.TargetObject)
+  if o.policy == nil || t.After(o.policyTm) {
+    o.policy = pb.Policy
+    o.policyTm = t
+  }
+}
+
+// Prunable returns the versions of the object objref that are not retained
+// by its retention policy as of time now.
+func (ind *ObjectIndex) Prunable(objref string, now time.Time) []string {
+  ind.lock.RLock()
+  defer ind.lock.RUnlock()
+
+  o, ok := ind.objs[objref]
+  if !ok {
+    return []string{}
+  }
+
+  p := o.policy
+  if p == nil {
+    p = ind.DefaultPolicy
+  }
+  return p.prunable(o, now)
+}
+
+// ObjectRefs returns the refs of every object in the index.
+func (ind *ObjectIndex) ObjectRefs() []string {
+  ind.lock.RLock()
+  defer ind.lock.RUnlock()
+
+  refs := make([]string, 0, len(ind.objs))
+  for ref := range ind.objs {
+    refs = append(refs, ref)
+  }
+  sort.Strings(refs)
+  return refs
 }
 
 // GetIter returns an iterator that walks the index according to the
@@ -95,7 +175,11 @@ func (ind *ObjectIndex) GetIter(req *http.Request) (it index.Iter,  err error) {
     return nil, errors.New("objindex: badly formed query request")
   }
 
-  it = newIter(ind, r.ObjectRef)
+  if r.Prunable {
+    it = ind.prunableIter(r.ObjectRef)
+  } else {
+    it = newIter(ind, r.ObjectRef)
+  }
   it.SkipN(r.SkipN)
   return it, nil
 }
@@ -105,11 +189,63 @@ func (ind *ObjectIndex) GetIter(req *http.Request) (it index.Iter,  err error) {
 // Use this to properly establish an object index that has just been
 // initialized by blobs not passed in chronological order.
 func (ind *ObjectIndex) Sort() {
+  ind.lock.Lock()
+  defer ind.lock.Unlock()
+
   for _, obj := range ind.objs {
     sort.Sort(obj)
   }
 }
 
+type objectRecord struct {
+  Versions []string
+  Tms []time.Time
+  Policy *Policy
+  PolicyTm time.Time
+  Content map[string]bool
+}
+
+// Save writes the index's objects to w.
+func (ind *ObjectIndex) Save(w io.Writer) error {
+  ind.lock.RLock()
+  defer ind.lock.RUnlock()
+
+  recs := make(map[string]*objectRecord, len(ind.objs))
+  for ref, o := range ind.objs {
+    recs[ref] = &objectRecord{
+      Versions: o.versions,
+      Tms: o.tms,
+      Policy: o.policy,
+      PolicyTm: o.policyTm,
+      Content: o.content,
+    }
+  }
+  return gob.NewEncoder(w).Encode(recs)
+}
+
+// Load replaces the index's objects with those written by Save.
+func (ind *ObjectIndex) Load(r io.Reader) error {
+  recs := map[string]*objectRecord{}
+  if err := gob.NewDecoder(r).Decode(&recs); err != nil {
+    return err
+  }
+
+  ind.lock.Lock()
+  defer ind.lock.Unlock()
+
+  ind.objs = make(map[string]*object, len(recs))
+  for ref, rec := range recs {
+    ind.objs[ref] = &object{
+      versions: rec.Versions,
+      tms: rec.Tms,
+      policy: rec.Policy,
+      policyTm: rec.PolicyTm,
+      content: rec.Content,
+    }
+  }
+  return nil
+}
+
 func (ind *ObjectIndex) RefAt(objref string, i int) (ref string,  err error) {
   ind.lock.RLock()
   defer ind.lock.RUnlock()
@@ -120,6 +256,16 @@ func (ind *ObjectIndex) RefAt(objref string, i int) (ref string,  err error) {
   return ind.objs[objref].At(i), nil
 }
 
+// HasContent returns true if ref is a content ref of any file meta
+// version of the object objref.
+func (ind *ObjectIndex) HasContent(objref, ref string) bool {
+  ind.lock.RLock()
+  defer ind.lock.RUnlock()
+
+  o, ok := ind.objs[objref]
+  return ok && o.content[ref]
+}
+
 // Len returns the number of blob refs in the index.
 func (ind *ObjectIndex) ObjLen(objref string) int {
   ind.lock.RLock()
@@ -170,3 +316,39 @@ func (it *iter) SkipN(n int) {
   it.at -= n
 }
 
+
+// prunableIter returns an iterator over the prunable versions of objref (or
+// of every object if objref is empty).
+func (ind *ObjectIndex) prunableIter(objref string) index.Iter {
+  objrefs := []string{objref}
+  if objref == "" {
+    objrefs = ind.ObjectRefs()
+  }
+
+  now := time.Now()
+  refs := []string{}
+  for _, oref := range objrefs {
+    pr := ind.Prunable(oref, now)
+    for i := len(pr) - 1; i >= 0; i-- {
+      refs = append(refs, pr[i])
+    }
+  }
+  return &sliceIter{refs: refs}
+}
+
+type sliceIter struct {
+  at int
+  refs []string
+}
+
+func (it *sliceIter) Next() (ref string, err error) {
+  if it.at >= 0 && it.at < len(it.refs) {
+    it.at++
+    return it.refs[it.at - 1], nil
+  }
+  return "", index.IndexEndErr
+}
+
+func (it *sliceIter) SkipN(n int) {
+  it.at += n
+}
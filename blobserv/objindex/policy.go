@@ -0,0 +1,97 @@
+package objindex
+
+import (
+  "fmt"
+  "time"
+  "github.com/rwcarlsen/cas/blob"
+)
+
+const PolicyType = "retention-policy"
+
+// Policy describes which versions of an object's history are retained.
+// The most recent version is always retained. Versions not retained by any
+// of the rules are prunable.
+type Policy struct {
+  KeepLast int // keep the KeepLast most recent versions
+  KeepDaily int // keep the newest version of each of the last KeepDaily days
+  KeepWeekly int // same as KeepDaily for ISO weeks
+  KeepMonthly int // same as KeepDaily for calendar months
+  KeepWithin time.Duration // keep all versions newer than this
+}
+
+// PolicyBlob assigns a retention policy to the object TargetObject. The
+// most recently time-stamped policy blob for an object wins.
+type PolicyBlob struct {
+  RcasType string
+  TargetObject string
+  Policy *Policy
+}
+
+// NewPolicyBlob creates a policy assignment for the object objref.
+func NewPolicyBlob(objref string, p *Policy) *PolicyBlob {
+  return &PolicyBlob{
+    RcasType: PolicyType,
+    TargetObject: objref,
+    Policy: p,
+  }
+}
+
+// prunable returns the versions of o not retained by p as of time now.
+// A nil policy retains everything.
+func (p *Policy) prunable(o *object, now time.Time) []string {
+  if p == nil || o.Len() == 0 {
+    return []string{}
+  }
+
+  keep := make([]bool, o.Len())
+  newest := o.Len() - 1
+  keep[newest] = true
+
+  for i, n := newest, 0; i >= 0 && n < p.KeepLast; i, n = i - 1, n + 1 {
+    keep[i] = true
+  }
+
+  for i := newest; i >= 0 && p.KeepWithin > 0; i-- {
+    if now.Sub(o.tms[i]) <= p.KeepWithin {
+      keep[i] = true
+    }
+  }
+
+  keepPeriodic(o, keep, p.KeepDaily, func(t time.Time) string {
+    return t.Format("2006-01-02")
+  })
+  keepPeriodic(o, keep, p.KeepWeekly, func(t time.Time) string {
+    y, w := t.ISOWeek()
+    return fmt.Sprint(y, "-", w)
+  })
+  keepPeriodic(o, keep, p.KeepMonthly, func(t time.Time) string {
+    return t.Format("2006-01")
+  })
+
+  refs := []string{}
+  for i, k := range keep {
+    if !k {
+      refs = append(refs, o.versions[i])
+    }
+  }
+  return refs
+}
+
+// keepPeriodic marks the newest version in each of the n most recent
+// periods (as identified by period) for keeping.
+func keepPeriodic(o *object, keep []bool, n int, period func(time.Time) string) {
+  last := ""
+  for i := o.Len() - 1; i >= 0 && n > 0; i-- {
+    key := period(o.tms[i])
+    if key == last {
+      continue
+    }
+    keep[i] = true
+    last = key
+    n--
+  }
+}
+
+func isPolicy(b *blob.Blob) bool {
+  return b.Type() == PolicyType
+}
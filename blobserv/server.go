@@ -2,13 +2,17 @@
 package blobserv
 
 import (
+  "io"
+  "crypto"
+  "io/ioutil"
+  "strings"
   "fmt"
-  "sort"
+  "sync"
   "time"
   "strconv"
   "errors"
   "path"
-  "io/ioutil"
+  "mime"
   "net/http"
   "mime/multipart"
   "github.com/rwcarlsen/cas/blob"
@@ -18,6 +22,9 @@ import (
   "github.com/rwcarlsen/cas/util"
   "github.com/rwcarlsen/cas/blobserv/timeindex"
   "github.com/rwcarlsen/cas/blobserv/objindex"
+  "github.com/rwcarlsen/cas/blobserv/typeindex"
+  "github.com/rwcarlsen/cas/blobserv/shareindex"
+  "github.com/rwcarlsen/cas/blobserv/audit"
 )
 
 const (
@@ -26,6 +33,7 @@ const (
   defaultReadTimeout = 60 * time.Second
   defaultWriteTimeout = 60 * time.Second
   defaultHeaderMax = 1 << 20 // 1 Mb
+  MaxBlobSize = 64 << 20 // 64 Mb
 )
 
 const (
@@ -36,44 +44,71 @@ const (
 
 const (
   GetField = "Blob-Ref"
+  // RefField declares the ref of a put blob and reports the ref it was
+  // stored under.
+  RefField = GetField
   IndexField = "Index-Name"
   ResultCountField = "Num-Index-Results"
   BoundaryField = "Blob-Boundary"
+  // SharePassField carries the password of the share named by a request's
+  // "via" parameter.
+  SharePassField = "Share-Pass"
 )
 
 var (
   DupIndexNameErr = errors.New("blobserv: index name already exists")
+  InvalidShareErr = errors.New("blobserv: share is invalid, expired, revoked or used up")
+  UnknownIndexErr = errors.New("blobserv: no index with that name")
 )
 
 func ListenAndServe(addr string, dbPath string) error {
-  bs := configServ(addr, dbPath)
+  bs, err := configServ(addr, dbPath)
+  if err != nil {
+    return err
+  }
   return bs.ListenAndServe()
 }
 
 func ListenAndServeTLS(addr, dbPath string, certFile, keyFile string) error {
-  bs := configServ(addr, dbPath)
+  bs, err := configServ(addr, dbPath)
+  if err != nil {
+    return err
+  }
   return bs.ListenAndServeTLS(certFile, keyFile)
 }
 
-func configServ(addr, dbPath string) *Server {
-  db, _ := blobdb.New(dbPath)
-  tInd := timeindex.New()
-  oInd := objindex.New()
-  for b := range db.Walk() {
-    tInd.Notify(b)
-    oInd.Notify(b)
+func configServ(addr, dbPath string) (*Server, error) {
+  db, err := blobdb.New(dbPath)
+  if err != nil {
+    return nil, err
   }
-  sort.Sort(tInd)
-  oInd.Sort()
+  bs := NewServer(addr, db)
+  bs.Reindex()
+  return bs, nil
+}
 
+// NewServer creates a blobserver for db listening on addr with the default
+// time, object and type indexes. The indexes must be populated with Reindex or
+// LoadIndexes before serving.
+func NewServer(addr string, db *blobdb.Dbase) *Server {
   serv := defaultHttpServer()
   serv.Addr = addr
   bs := &Server{Db: db, Serv: serv}
-  bs.AddIndex("time", tInd)
-  bs.AddIndex("object", oInd)
+  bs.AddIndex("time", timeindex.New())
+  bs.AddIndex("object", objindex.New())
+  bs.AddIndex("type", typeindex.New())
+  bs.shares = shareindex.New()
+  bs.AddIndex("share", bs.shares)
   return bs
 }
 
+// OpenShareLog keeps share use counts and revocations in the durable log
+// at path (see shareindex.ShareIndex.Open). Without it, use limits reset
+// when the server restarts.
+func (bs *Server) OpenShareLog(path string) error {
+  return bs.shares.Open(path)
+}
+
 func defaultHttpServer() *http.Server {
   return &http.Server{
     Addr: DefaultAddr,
@@ -86,7 +121,30 @@ func defaultHttpServer() *http.Server {
 type Server struct {
   Db *blobdb.Dbase
   Serv *http.Server
+  // CheckpointInterval is how often persistent index state is saved after
+  // LoadIndexes.
+  CheckpointInterval time.Duration
+  // URLKey signs capability urls (see SignURL). A random key is used if
+  // it is nil, so urls don't survive a restart.
+  URLKey []byte
+  // OldURLKeys are retired url keys whose urls are still accepted.
+  // Rotate keys by moving URLKey here; dropping a key revokes every url
+  // it signed.
+  OldURLKeys [][]byte
+  // MaxURLTTL caps how long signed urls stay valid. Zero uses
+  // DefaultMaxURLTTL.
+  MaxURLTTL time.Duration
+  // Audit records every get, put and index query if it isn't nil.
+  Audit *audit.Log
   inds map[string]index.Index
+  shares *shareindex.ShareIndex
+  feed feed
+  lock sync.Mutex
+  stateDir string
+  journal *journal
+  journalNum int
+  // putLock is held for reading by stores and for writing by checkpoints.
+  putLock sync.RWMutex
 }
 
 func (bs *Server) AddIndex(name string, ind index.Index) error {
@@ -121,10 +179,25 @@ func (bs *Server) prepareListen() {
     bs.Serv = defaultHttpServer()
   }
 
+  if bs.shares == nil {
+    bs.shares = shareindex.New()
+    bs.AddIndex("share", bs.shares)
+  }
+
+  if bs.URLKey == nil {
+    bs.URLKey = NewURLKey()
+  }
+
   http.Handle("/", &defHandler{})
-  http.Handle("/ref/", auth.Handler{&getHandler{bs: bs}})
-  http.Handle("/put/", auth.Handler{&putHandler{bs: bs}})
-  http.Handle("/index/", auth.Handler{&indexHandler{bs: bs}})
+  http.Handle("/ref/", auth.Handler{AuthHandler: &getHandler{bs: bs}, Role: auth.ReadRole})
+  http.Handle("/file/", auth.Handler{AuthHandler: &fileHandler{bs: bs}, Role: auth.ReadRole})
+  http.Handle("/put/", auth.Handler{AuthHandler: &putHandler{bs: bs}, Role: auth.WriteRole})
+  http.Handle("/index/", auth.Handler{AuthHandler: &indexHandler{bs: bs}, Role: auth.ReadRole})
+  http.Handle("/enumerate/", auth.Handler{AuthHandler: &enumerateHandler{bs: bs}, Role: auth.ReadRole})
+  http.Handle("/subscribe/", auth.Handler{AuthHandler: &subscribeHandler{bs: bs}, Role: auth.ReadRole})
+  http.Handle("/stat/", auth.Handler{AuthHandler: &statHandler{bs: bs}, Role: auth.ReadRole})
+  http.Handle("/sign/", auth.Handler{AuthHandler: &signHandler{bs: bs}, Role: auth.ReadRole})
+  http.Handle("/audit/", auth.Handler{AuthHandler: &auditHandler{bs: bs}, Role: auth.AdminRole})
 }
 
 func (bs *Server) ListenAndServe() error {
@@ -148,60 +221,88 @@ type getHandler struct {
 }
 
 func (h *getHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+  if isBatch(req) {
+    h.batchGet(w, req)
+    return
+  }
+
+  ref := path.Base(req.URL.Path)
+  if req.Method == "HEAD" {
+    h.head(w, ref)
+    return
+  }
+
+  e := &audit.Entry{Op: audit.Get, Ref: ref, Result: audit.Failed}
+  defer h.bs.record(req, e)
   defer func() {
     if r := recover(); r != nil {
-      w.Header().Set(ActionStatus, ActionFailed)
+      sendErr(w, r)
       fmt.Println("blob post failed: ", r)
     }
   }()
 
-  ref := path.Base(req.URL.Path)
   b, err := h.bs.Db.Get(ref)
   util.Check(err)
 
+  h.send(w, b, e)
+}
+
+func (h *getHandler) send(w http.ResponseWriter, b *blob.Blob, e *audit.Entry) {
   w.Header().Set(ActionStatus, ActionSuccess)
   w.Write(b.Content())
-  fmt.Println("successful retrieval")
+  e.Bytes, e.Result = int64(len(b.Content())), audit.Ok
 }
 
 // Unauthorized checks for and handles cases where authentication can occur via
-// share blobs.
+// share blobs or capability urls. Batch gets and existence checks are not
+// shared.
 func (h *getHandler) Unauthorized(w http.ResponseWriter, req *http.Request) {
+  if isBatch(req) || req.Method == "HEAD" {
+    deny(w, req)
+    return
+  }
+
+  ref := path.Base(req.URL.Path)
+  e := &audit.Entry{Op: audit.Get, Ref: ref, Result: audit.Failed}
+  defer h.bs.record(req, e)
   defer func() {
     if r := recover(); r != nil {
-      w.Header().Set(ActionStatus, ActionFailed)
+      sendErr(w, r)
       fmt.Println("blob post failed: ", r)
     }
   }()
 
-  shareRef := req.FormValue("via")
-  if shareRef == "" {
-    auth.SendUnauthorized(w)
+  if req.FormValue("sig") != "" {
+    e.Capability = true
+    b, err := h.bs.Db.Get(ref)
+    if err != nil || !h.bs.capAllows(req, b) {
+      e.Result = audit.Denied
+      deny(w, req)
+      return
+    }
+
+    h.send(w, b, e)
     return
   }
 
-  b, err := h.bs.Db.Get(shareRef)
+  shareRef, share, err := h.bs.viaShare(req)
+  e.Share = shareRef
   if err != nil {
-    auth.SendUnauthorized(w)
+    e.Result = audit.Denied
+    deny(w, req)
     return
   }
 
-  share := &blob.Share{}
-  err = blob.Unmarshal(b, share)
-  util.Check(err)
-
-  ref := path.Base(req.URL.Path)
-  b, err = h.bs.Db.Get(ref)
+  b, err := h.bs.Db.Get(ref)
   util.Check(err)
 
-  if !share.AuthorizedGet(b) {
-    auth.SendUnauthorized(w)
+  if !h.bs.shareGet(req, shareRef, share, b) {
+    e.Result = audit.Denied
+    deny(w, req)
     return
   }
 
-  w.Header().Set(ActionStatus, ActionSuccess)
-  w.Write(b.Content())
-  fmt.Println("successful retrieval")
+  h.send(w, b, e)
 }
 
 type putHandler struct {
@@ -209,32 +310,227 @@ type putHandler struct {
 }
 
 func (h *putHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+  if isBatch(req) {
+    h.batchPut(w, req)
+    return
+  }
+
+  e := &audit.Entry{Op: audit.Put, Result: audit.Failed}
+  defer h.bs.record(req, e)
   defer func() {
     if r := recover(); r != nil {
-      w.Header().Set(ActionStatus, ActionFailed)
+      sendErr(w, r)
       fmt.Println("blob post issues: ", r)
     }
   }()
 
-  body, err := ioutil.ReadAll(req.Body)
+  b, err := readBlob(req)
   util.Check(err)
 
-  b := blob.NewRaw(body)
-  err = h.bs.Db.Put(b)
-  if err == blobdb.HashCollideErr {
-    w.Header().Set(ActionStatus, ActionFailed)
+  h.put(w, b, e)
+}
+
+func (h *putHandler) put(w http.ResponseWriter, b *blob.Blob, e *audit.Entry) {
+  e.Ref, e.Bytes = b.Ref(), int64(len(b.Content()))
+
+  if err := checkShare(b); err != nil {
+    sendErr(w, err)
     return
   }
-  h.bs.notify(b)
 
+  err := h.bs.store(b)
+  if err == nil {
+    e.Result = audit.Ok
+  } else if err == blobdb.DupContentErr {
+    e.Result = audit.Dup
+  } else {
+    sendErr(w, err)
+    return
+  }
+
+  w.Header().Set(RefField, b.Ref())
   w.Header().Set(ActionStatus, ActionSuccess)
-  fmt.Println("successful post")
+}
+
+// checkShare returns an error if b is a share blob that is malformed or
+// invalid (see blob.Share.Validate).
+func checkShare(b *blob.Blob) error {
+  if b.Type() != blob.ShareType {
+    return nil
+  }
+
+  sh := &blob.Share{}
+  if err := blob.Unmarshal(b, sh); err != nil {
+    return BadRequestErr
+  }
+  return sh.Validate()
+}
+
+// readBlob reads a blob of at most MaxBlobSize bytes from a request body.
+// If the client declares the blob's ref (in the RefField header or as
+// /put/<ref>), the blob is hashed with the ref's hash function and must
+// match it.
+func readBlob(req *http.Request) (*blob.Blob, error) {
+  ref := req.Header.Get(RefField)
+  if base := path.Base(req.URL.Path); ref == "" && base != "put" {
+    ref = base
+  }
+
+  var h crypto.Hash
+  if ref != "" {
+    var err error
+    if h, _, err = blob.ParseRef(ref); err != nil {
+      return nil, err
+    }
+  }
+
+  data, err := ioutil.ReadAll(io.LimitReader(req.Body, MaxBlobSize + 1))
+  if err != nil {
+    return nil, err
+  } else if len(data) > MaxBlobSize {
+    return nil, TooLargeErr
+  }
+
+  b := blob.NewRaw(data)
+  if ref == "" {
+    return b, nil
+  }
+
+  b.Hash = h
+  if b.Ref() != ref {
+    return nil, RefMismatchErr
+  }
+  return b, nil
 }
 
 // Unauthorized checks for and handles cases where authentication can occur via
-// share blobs.
+// share blobs. Batch puts are not shared.
 func (h *putHandler) Unauthorized(w http.ResponseWriter, req *http.Request) {
-  auth.SendUnauthorized(w)
+  if isBatch(req) {
+    deny(w, req)
+    return
+  }
+
+  e := &audit.Entry{Op: audit.Put, Result: audit.Failed}
+  defer h.bs.record(req, e)
+  defer func() {
+    if r := recover(); r != nil {
+      sendErr(w, r)
+      fmt.Println("blob post issues: ", r)
+    }
+  }()
+
+  shareRef, share, err := h.bs.viaShare(req)
+  e.Share = shareRef
+  if err != nil {
+    e.Result = audit.Denied
+    deny(w, req)
+    return
+  }
+
+  b, err := readBlob(req)
+  util.Check(err)
+
+  if !sharePutType(b) || !share.AuthorizedPut(b) || !h.bs.shares.Use(shareRef, share.MaxUses) {
+    e.Ref, e.Result = b.Ref(), audit.Denied
+    deny(w, req)
+    return
+  }
+
+  if !h.bs.Db.Has(b.Ref()) {
+    util.Check(h.bs.shares.Put(shareRef, b.Ref()))
+  }
+  h.put(w, b, e)
+}
+
+// sharePutType returns true if b may be stored through a share: only new
+// timestamped file meta versions. Share, revocation and retention policy
+// blobs grant or take away access so a share holder must never be able to
+// store them.
+func sharePutType(b *blob.Blob) bool {
+  switch b.Type() {
+    case blob.ShareType, blob.RevocationType, objindex.PolicyType:
+      return false
+    case blob.MetaType:
+      _, err := b.Timestamp()
+      return err == nil
+  }
+  return false
+}
+
+// shareGet returns true if sh (stored as shareRef) grants retrieval of b
+// either as content of the meta named after the share in the request's
+// "via" parameter or directly. Only direct gets count as uses of the
+// share; content is covered by the use that retrieved its meta.
+//
+// Blobs stored through shares are only granted by TargetRefs: their mount
+// path and content refs were chosen by a share holder (see
+// shareindex.ShareIndex.SharedPut).
+func (bs *Server) shareGet(req *http.Request, shareRef string, sh *blob.Share, b *blob.Blob) bool {
+  via := strings.Split(req.FormValue("via"), ",")
+  if len(via) == 2 && !bs.shares.SharedPut(via[1]) {
+    meta, err := bs.Db.Get(via[1])
+    if err == nil && sh.AuthorizedContent(meta, b) {
+      return true
+    }
+  }
+
+  good := sh.AuthorizedTarget(b)
+  if !good && !bs.shares.SharedPut(b.Ref()) {
+    good = sh.AuthorizedGet(b)
+  }
+  return good && bs.shares.Use(shareRef, sh.MaxUses)
+}
+
+// viaShare returns the share blob named by the request's "via" parameter
+// if it is currently usable: not revoked or expired, granted to the
+// request's identity (if any) and the request's share password (see
+// sharePass) matches any share password. Use limits are enforced as uses
+// are counted (see shareGet) so content of metas retrieved before a share
+// was used up stays retrievable.
+//
+// "via" may be followed by a comma and a file meta ref to fetch that
+// meta's content blobs (see blob.Share.AuthorizedContent). The requested
+// share ref is returned even if the share is unusable.
+func (bs *Server) viaShare(req *http.Request) (shareRef string, sh *blob.Share, err error) {
+  shareRef = strings.Split(req.FormValue("via"), ",")[0]
+  if shareRef == "" {
+    return "", nil, InvalidShareErr
+  }
+
+  b, err := bs.Db.Get(shareRef)
+  if err != nil || b.Type() != blob.ShareType {
+    return shareRef, nil, InvalidShareErr
+  }
+
+  sh = &blob.Share{}
+  if err := blob.Unmarshal(b, sh); err != nil || sh.Auth == nil {
+    return shareRef, nil, InvalidShareErr
+  }
+
+  if bs.shares.Revoked(shareRef) || sh.Expired(time.Now()) {
+    return shareRef, nil, InvalidShareErr
+  } else if !sh.CheckPassword(sharePass(req)) {
+    return shareRef, nil, InvalidShareErr
+  } else if !sh.AuthorizedFor(auth.Identity(req)) {
+    return shareRef, nil, InvalidShareErr
+  }
+  return shareRef, sh, nil
+}
+
+// sharePass returns the share password sent in the SharePassField header
+// or, for form posts from browsers, the "pass" form field. Passwords are
+// never read from the url so they stay out of logs and history.
+func sharePass(req *http.Request) string {
+  if pass := req.Header.Get(SharePassField); pass != "" {
+    return pass
+  }
+
+  mt, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+  if req.Method == "POST" && mt == "application/x-www-form-urlencoded" {
+    return req.PostFormValue("pass")
+  }
+  return ""
 }
 
 type indexHandler struct {
@@ -242,17 +538,19 @@ type indexHandler struct {
 }
 
 func (h *indexHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+  name := req.Header.Get(IndexField)
+  e := &audit.Entry{Op: audit.Query, Index: name, Result: audit.Failed}
+  defer h.bs.record(req, e)
   defer func() {
     if r := recover(); r != nil {
-      w.Header().Set(ActionStatus, ActionFailed)
+      sendErr(w, r)
       fmt.Println("index access failed: ", r)
     }
   }()
 
-  name := req.Header.Get(IndexField)
   ind, ok := h.bs.inds[name]
   if !ok {
-    panic("invalid index name")
+    panic(UnknownIndexErr)
   }
 
   it, err := ind.GetIter(req)
@@ -266,22 +564,28 @@ func (h *indexHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
   w.Header().Set(BoundaryField, refs.Boundary() )
 
   defer refs.Close()
-  for i := 0; i < n; i++ {
+  for i := 0; i < n; {
     ref, err := it.Next()
     if err != nil {
       break
     }
 
     b, err := h.bs.Db.Get(ref)
-    util.Check(err)
+    if err != nil {
+      // removed (e.g. by gc) or quarantined since it was indexed
+      continue
+    }
+    i++
 
     part, err := refs.CreateFormFile("blob-ref", ref)
     util.Check(err)
     part.Write(b.Content())
+    e.Bytes += int64(len(b.Content()))
   }
+  e.Result = audit.Ok
 }
 
 func (h *indexHandler) Unauthorized(w http.ResponseWriter, req *http.Request) {
-  auth.SendUnauthorized(w)
+  deny(w, req)
 }
 
@@ -0,0 +1,289 @@
+package blobserv
+
+import (
+  "fmt"
+  "time"
+  "bytes"
+  "testing"
+  "net/http"
+  "net/http/httptest"
+  "github.com/rwcarlsen/cas/auth"
+  "github.com/rwcarlsen/cas/blob"
+  "github.com/rwcarlsen/cas/blobdb"
+  "github.com/rwcarlsen/cas/blobserv/objindex"
+)
+
+func testServer(t *testing.T, blobs ...*blob.Blob) *Server {
+  bs := NewServer("", blobdb.NewWith(blobdb.NewMemStore()))
+  for _, b := range blobs {
+    if err := bs.store(b); err != nil {
+      t.Fatal(err)
+    }
+  }
+  return bs
+}
+
+// shareBlob stores sh and returns its ref.
+func shareBlob(t *testing.T, bs *Server, sh *blob.Share) string {
+  b, err := blob.Marshal(sh)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := bs.store(b); err != nil {
+    t.Fatal(err)
+  }
+  return b.Ref()
+}
+
+// sharedGet makes an unauthenticated get of ref via the share (and meta)
+// refs in via and returns the response code.
+func sharedGet(bs *Server, ref, via, pass string) int {
+  req := httptest.NewRequest("GET", "/ref/" + ref + "?via=" + via, nil)
+  if pass != "" {
+    req.Header.Set(SharePassField, pass)
+  }
+  w := httptest.NewRecorder()
+  (&getHandler{bs: bs}).Unauthorized(w, req)
+  return w.Code
+}
+
+func TestShareMaxUses(t *testing.T) {
+  b := blob.NewRaw([]byte("shared"))
+  bs := testServer(t, b)
+
+  sh := blob.NewShare()
+  sh.Auth.StaticGet = true
+  sh.TargetRefs = []string{b.Ref()}
+  sh.MaxUses = 2
+  shareRef := shareBlob(t, bs, sh)
+
+  for i := 0; i < sh.MaxUses; i++ {
+    if code := sharedGet(bs, b.Ref(), shareRef, ""); code != http.StatusOK {
+      t.Fatalf("use %v: got status %v", i + 1, code)
+    }
+  }
+  if code := sharedGet(bs, b.Ref(), shareRef, ""); code != http.StatusForbidden {
+    t.Errorf("use past MaxUses: got status %v, want %v", code, http.StatusForbidden)
+  }
+  if n := bs.shares.Uses(shareRef); n != sh.MaxUses {
+    t.Errorf("got %v recorded uses, want %v", n, sh.MaxUses)
+  }
+}
+
+func TestShareContentUses(t *testing.T) {
+  content := blob.NewRaw([]byte("file data"))
+  m := blob.NewMeta()
+  m.ContentRefs = []string{content.Ref()}
+  meta, err := blob.Marshal(m)
+  if err != nil {
+    t.Fatal(err)
+  }
+  other := blob.NewRaw([]byte("not shared"))
+  bs := testServer(t, content, meta, other)
+
+  sh := blob.NewShare()
+  sh.Auth.StaticGet = true
+  sh.TargetRefs = []string{meta.Ref()}
+  sh.MaxUses = 1
+  shareRef := shareBlob(t, bs, sh)
+  via := shareRef + "," + meta.Ref()
+
+  if code := sharedGet(bs, meta.Ref(), shareRef, ""); code != http.StatusOK {
+    t.Fatalf("meta get: got status %v", code)
+  }
+  // content stays retrievable after the share's only use was spent on the meta
+  for i := 0; i < 3; i++ {
+    if code := sharedGet(bs, content.Ref(), via, ""); code != http.StatusOK {
+      t.Fatalf("content get %v: got status %v", i + 1, code)
+    }
+  }
+  if code := sharedGet(bs, other.Ref(), via, ""); code != http.StatusForbidden {
+    t.Errorf("non-content get: got status %v, want %v", code, http.StatusForbidden)
+  }
+  if code := sharedGet(bs, meta.Ref(), shareRef, ""); code != http.StatusForbidden {
+    t.Errorf("second meta get: got status %v, want %v", code, http.StatusForbidden)
+  }
+  if n := bs.shares.Uses(shareRef); n != 1 {
+    t.Errorf("got %v recorded uses, want 1", n)
+  }
+}
+
+func TestSharePassword(t *testing.T) {
+  b := blob.NewRaw([]byte("shared"))
+  bs := testServer(t, b)
+
+  sh := blob.NewShare()
+  sh.Auth.StaticGet = true
+  sh.TargetRefs = []string{b.Ref()}
+  sh.MaxUses = 1
+  sh.SetPassword("secret")
+  shareRef := shareBlob(t, bs, sh)
+
+  if code := sharedGet(bs, b.Ref(), shareRef, ""); code != http.StatusForbidden {
+    t.Errorf("no password: got status %v, want %v", code, http.StatusForbidden)
+  }
+  if code := sharedGet(bs, b.Ref(), shareRef, "wrong"); code != http.StatusForbidden {
+    t.Errorf("bad password: got status %v, want %v", code, http.StatusForbidden)
+  }
+  // failed attempts don't use up the share
+  if code := sharedGet(bs, b.Ref(), shareRef, "secret"); code != http.StatusOK {
+    t.Errorf("good password: got status %v, want %v", code, http.StatusOK)
+  }
+}
+
+// sharedPut makes an unauthenticated put of b via shareRef and returns
+// the response code.
+func sharedPut(bs *Server, b *blob.Blob, shareRef string) int {
+  req := httptest.NewRequest("POST", "/put/?via=" + shareRef, bytes.NewReader(b.Content()))
+  w := httptest.NewRecorder()
+  (&putHandler{bs: bs}).Unauthorized(w, req)
+  return w.Code
+}
+
+func TestSharePutTypes(t *testing.T) {
+  obj := blob.NewObject()
+  secret := blob.NewRaw([]byte("secret"))
+  bs := testServer(t, obj, secret)
+
+  sh := blob.NewShare()
+  sh.Auth.DynamicPut = true
+  sh.TargetRefs = []string{obj.Ref()}
+  sh.MaxUses = 10
+  shareRef := shareBlob(t, bs, sh)
+
+  // blobs claiming to be versions of the shared object
+  now := time.Now().Format(blob.TimeFormat)
+  forged := func(tp, fields string) *blob.Blob {
+    return blob.NewRaw([]byte(fmt.Sprintf(`{"RcasType":%q,"RcasObjectRef":%q,"RcasTimestamp":%q%v}`, tp, obj.Ref(), now, fields)))
+  }
+  share := forged(blob.ShareType, fmt.Sprintf(`,"Version":2,"TargetRefs":[%q],"Auth":{"StaticGet":true}`, secret.Ref()))
+  bad := []*blob.Blob{
+    share,
+    forged(blob.RevocationType, fmt.Sprintf(`,"ShareRef":%q`, shareRef)),
+    forged(objindex.PolicyType, `,"KeepLast":1`),
+    forged("note", ""),
+    blob.NewRaw([]byte(fmt.Sprintf(`{"RcasType":%q,"RcasObjectRef":%q}`, blob.MetaType, obj.Ref()))),
+  }
+  for i, b := range bad {
+    if code := sharedPut(bs, b, shareRef); code != http.StatusForbidden {
+      t.Errorf("put %v: got status %v, want %v", i, code, http.StatusForbidden)
+    }
+    if bs.Db.Has(b.Ref()) {
+      t.Errorf("put %v: blob was stored", i)
+    }
+  }
+  if code := sharedGet(bs, secret.Ref(), share.Ref(), ""); code != http.StatusForbidden {
+    t.Errorf("get via forged share: got status %v, want %v", code, http.StatusForbidden)
+  }
+
+  m := blob.NewMeta()
+  m.RcasObjectRef = obj.Ref()
+  meta, err := blob.Marshal(m)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if code := sharedPut(bs, meta, shareRef); code != http.StatusOK {
+    t.Errorf("meta put: got status %v, want %v", code, http.StatusOK)
+  } else if !bs.Db.Has(meta.Ref()) {
+    t.Errorf("meta put: blob wasn't stored")
+  }
+}
+
+// mountedMeta returns a timestamped file meta of object objref (if not
+// empty) mounted at pth with content.
+func mountedMeta(t *testing.T, objref, pth string, content *blob.Blob) *blob.Blob {
+  m := blob.NewMeta()
+  m.RcasObjectRef = objref
+  m.ContentRefs = []string{content.Ref()}
+  if err := m.SetNotes(blob.MountNotesKey, &struct{ Path string }{pth}); err != nil {
+    t.Fatal(err)
+  }
+  b, err := blob.Marshal(m)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return b
+}
+
+func TestShareForgedPath(t *testing.T) {
+  obj := blob.NewObject()
+  photo := blob.NewRaw([]byte("photo"))
+  secret := blob.NewRaw([]byte("secret"))
+  owned := mountedMeta(t, "", "photos/a.jpg", photo)
+  bs := testServer(t, obj, photo, secret, owned)
+
+  prefix := blob.NewShare()
+  prefix.PathPrefixes = []string{"photos"}
+  prefixRef := shareBlob(t, bs, prefix)
+
+  put := blob.NewShare()
+  put.Auth.DynamicPut = true
+  put.TargetRefs = []string{obj.Ref()}
+  putRef := shareBlob(t, bs, put)
+
+  if code := sharedGet(bs, owned.Ref(), prefixRef, ""); code != http.StatusOK {
+    t.Fatalf("owned meta get: got status %v", code)
+  } else if code := sharedGet(bs, photo.Ref(), prefixRef + "," + owned.Ref(), ""); code != http.StatusOK {
+    t.Fatalf("owned content get: got status %v", code)
+  }
+
+  // a share holder claims a meta of their own is under the shared prefix
+  forged := mountedMeta(t, obj.Ref(), "photos/b.jpg", secret)
+  if code := sharedPut(bs, forged, putRef); code != http.StatusOK {
+    t.Fatalf("forged meta put: got status %v", code)
+  }
+  if code := sharedGet(bs, forged.Ref(), prefixRef, ""); code != http.StatusForbidden {
+    t.Errorf("forged meta get: got status %v, want %v", code, http.StatusForbidden)
+  }
+  if code := sharedGet(bs, secret.Ref(), prefixRef + "," + forged.Ref(), ""); code != http.StatusForbidden {
+    t.Errorf("forged content get: got status %v, want %v", code, http.StatusForbidden)
+  }
+}
+
+func TestShareGrantee(t *testing.T) {
+  b := blob.NewRaw([]byte("shared"))
+  bs := testServer(t, b)
+
+  us, err := auth.LoadUsers("")
+  if err != nil {
+    t.Fatal(err)
+  }
+  none, _ := auth.LoadUsers("")
+  defer auth.SetUsers(none)
+  for _, name := range []string{"guest", "other"} {
+    if err := us.Add(name, "pass", auth.GuestRole); err != nil {
+      t.Fatal(err)
+    }
+  }
+  auth.SetUsers(us)
+
+  sh := blob.NewShare()
+  sh.Auth.StaticGet = true
+  sh.TargetRefs = []string{b.Ref()}
+  sh.Grantee = "guest"
+  shareRef := shareBlob(t, bs, sh)
+
+  h := auth.Handler{AuthHandler: &getHandler{bs: bs}, Role: auth.ReadRole}
+  get := func(user, via string) int {
+    req := httptest.NewRequest("GET", "/ref/" + b.Ref() + "?via=" + via, nil)
+    if user != "" {
+      req.SetBasicAuth(user, "pass")
+    }
+    w := httptest.NewRecorder()
+    h.ServeHTTP(w, req)
+    return w.Code
+  }
+
+  if code := get("guest", ""); code != http.StatusForbidden {
+    t.Errorf("guest get without a share: got status %v, want %v", code, http.StatusForbidden)
+  }
+  if code := get("guest", shareRef); code != http.StatusOK {
+    t.Errorf("grantee get: got status %v, want %v", code, http.StatusOK)
+  }
+  if code := get("other", shareRef); code != http.StatusForbidden {
+    t.Errorf("other guest get: got status %v, want %v", code, http.StatusForbidden)
+  }
+  if code := get("", shareRef); code != http.StatusForbidden {
+    t.Errorf("anonymous get: got status %v, want %v", code, http.StatusForbidden)
+  }
+}
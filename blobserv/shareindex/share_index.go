@@ -0,0 +1,207 @@
+package shareindex
+
+import (
+  "io"
+  "os"
+  "errors"
+  "io/ioutil"
+  "sync"
+  "net/http"
+  "encoding/gob"
+  "encoding/json"
+  "github.com/rwcarlsen/cas/blob"
+  "github.com/rwcarlsen/cas/blobserv/index"
+)
+
+// Request asks for the revocation blobs of the share ShareRef.
+type Request struct {
+  ShareRef string
+  SkipN int
+}
+
+// ShareIndex tracks server-side share state: how many times each share has
+// been used, which shares have been revoked and which blobs were stored
+// through shares. Use counts and shared puts can't be rebuilt from blobs,
+// so servers should keep them in a durable log (see Open).
+type ShareIndex struct {
+  uses map[string]int
+  revoked map[string][]string // share ref -> revocation blob refs
+  puts map[string]string // blob ref -> ref of the share it was stored through
+  log *os.File
+  lock sync.RWMutex
+}
+
+func New() *ShareIndex {
+  return &ShareIndex{
+    uses: map[string]int{},
+    revoked: map[string][]string{},
+    puts: map[string]string{},
+  }
+}
+
+// Notify records revocation blobs. All other blobs are ignored.
+func (ind *ShareIndex) Notify(blobs ...*blob.Blob) {
+  ind.lock.Lock()
+  defer ind.lock.Unlock()
+
+  for _, b := range blobs {
+    if b.Type() != blob.RevocationType {
+      continue
+    }
+
+    rev := &blob.Revocation{}
+    if err := blob.Unmarshal(b, rev); err != nil || rev.ShareRef == "" {
+      continue
+    }
+    if ind.addRevocation(rev.ShareRef, b.Ref()) {
+      ind.record("revoke %v %v", rev.ShareRef, b.Ref())
+    }
+  }
+}
+
+// addRevocation returns false if revRef was already recorded for
+// shareRef. ind.lock must be held.
+func (ind *ShareIndex) addRevocation(shareRef, revRef string) bool {
+  for _, ref := range ind.revoked[shareRef] {
+    if ref == revRef {
+      return false
+    }
+  }
+  ind.revoked[shareRef] = append(ind.revoked[shareRef], revRef)
+  return true
+}
+
+// GetIter returns an iterator over the revocation blobs of the share
+// described in the http request.
+func (ind *ShareIndex) GetIter(req *http.Request) (it index.Iter, err error) {
+  data, err := ioutil.ReadAll(req.Body)
+  if err != nil {
+    return nil, errors.New("shareindex: badly formed query request")
+  }
+
+  var r Request
+  err = json.Unmarshal(data, &r)
+  if err != nil {
+    return nil, errors.New("shareindex: badly formed query request")
+  }
+
+  ind.lock.RLock()
+  refs := append([]string{}, ind.revoked[r.ShareRef]...)
+  ind.lock.RUnlock()
+
+  it = &iter{refs: refs}
+  it.SkipN(r.SkipN)
+  return it, nil
+}
+
+// Revoked returns true if a revocation blob exists for shareRef.
+func (ind *ShareIndex) Revoked(shareRef string) bool {
+  ind.lock.RLock()
+  defer ind.lock.RUnlock()
+  return len(ind.revoked[shareRef]) > 0
+}
+
+// Uses returns the number of times shareRef has been used.
+func (ind *ShareIndex) Uses(shareRef string) int {
+  ind.lock.RLock()
+  defer ind.lock.RUnlock()
+  return ind.uses[shareRef]
+}
+
+// Use records one use of shareRef. It returns false without recording
+// anything if max (> 0) uses have already been made or the use couldn't
+// be logged.
+func (ind *ShareIndex) Use(shareRef string, max int) bool {
+  ind.lock.Lock()
+  defer ind.lock.Unlock()
+
+  n := ind.uses[shareRef] + 1
+  if max > 0 && n > max {
+    return false
+  } else if err := ind.record("use %v %v", shareRef, n); err != nil {
+    return false
+  }
+  ind.uses[shareRef] = n
+  return true
+}
+
+// Put records that ref is being stored through shareRef. It must be
+// called before the blob is stored.
+func (ind *ShareIndex) Put(shareRef, ref string) error {
+  ind.lock.Lock()
+  defer ind.lock.Unlock()
+
+  if err := ind.record("put %v %v", shareRef, ref); err != nil {
+    return err
+  }
+  ind.puts[ref] = shareRef
+  return nil
+}
+
+// SharedPut returns true if ref was stored through a share. Anything such
+// a blob says about itself (e.g. its mount path or content) comes from a
+// share holder rather than the owner of the blobserver.
+func (ind *ShareIndex) SharedPut(ref string) bool {
+  ind.lock.RLock()
+  defer ind.lock.RUnlock()
+  _, ok := ind.puts[ref]
+  return ok
+}
+
+type shareRecord struct {
+  Uses map[string]int
+  Revoked map[string][]string
+  Puts map[string]string
+}
+
+// Save writes the use counts, revocations and shared puts to w.
+func (ind *ShareIndex) Save(w io.Writer) error {
+  ind.lock.RLock()
+  defer ind.lock.RUnlock()
+  return gob.NewEncoder(w).Encode(&shareRecord{Uses: ind.uses, Revoked: ind.revoked, Puts: ind.puts})
+}
+
+// Load merges the use counts, revocations and shared puts written by Save
+// into the index. Counts never go down, so state from an older checkpoint can't
+// undo uses already loaded from the log.
+func (ind *ShareIndex) Load(r io.Reader) error {
+  rec := &shareRecord{}
+  if err := gob.NewDecoder(r).Decode(rec); err != nil {
+    return err
+  }
+
+  ind.lock.Lock()
+  defer ind.lock.Unlock()
+
+  for ref, n := range rec.Uses {
+    if n > ind.uses[ref] {
+      ind.uses[ref] = n
+    }
+  }
+  for ref, revs := range rec.Revoked {
+    for _, rev := range revs {
+      ind.addRevocation(ref, rev)
+    }
+  }
+  for ref, shareRef := range rec.Puts {
+    ind.puts[ref] = shareRef
+  }
+  return nil
+}
+
+type iter struct {
+  at int
+  refs []string
+}
+
+func (it *iter) Next() (ref string, err error) {
+  if it.at >= 0 && it.at < len(it.refs) {
+    it.at++
+    return it.refs[it.at - 1], nil
+  }
+  return "", index.IndexEndErr
+}
+
+func (it *iter) SkipN(n int) {
+  it.at += n
+}
@@ -0,0 +1,131 @@
+package shareindex
+
+import (
+  "os"
+  "fmt"
+  "bufio"
+  "strings"
+  "strconv"
+  "path/filepath"
+)
+
+// Open loads the share state log at path (creating it if necessary) and
+// appends every later use, revocation and shared put to it. Records are synced to disk
+// before Use returns, so use limits survive crashes, restarts and index
+// rebuilds. The log is compacted each time it is opened.
+func (ind *ShareIndex) Open(path string) error {
+  ind.lock.Lock()
+  defer ind.lock.Unlock()
+
+  if err := ind.readLog(path); err != nil && !os.IsNotExist(err) {
+    return err
+  }
+  if err := ind.compactLog(path); err != nil {
+    return err
+  }
+
+  f, err := os.OpenFile(path, os.O_WRONLY | os.O_APPEND, 0600)
+  if err != nil {
+    return err
+  }
+  if ind.log != nil {
+    ind.log.Close()
+  }
+  ind.log = f
+  return nil
+}
+
+// Close closes the share state log.
+func (ind *ShareIndex) Close() error {
+  ind.lock.Lock()
+  defer ind.lock.Unlock()
+
+  if ind.log == nil {
+    return nil
+  }
+  err := ind.log.Close()
+  ind.log = nil
+  return err
+}
+
+// readLog merges the records in the log at path into the index. Each line
+// is either "use <share> <total uses>", "revoke <share> <revocation>" or
+// "put <share> <blob>".
+func (ind *ShareIndex) readLog(path string) error {
+  f, err := os.Open(path)
+  if err != nil {
+    return err
+  }
+  defer f.Close()
+
+  scan := bufio.NewScanner(f)
+  for scan.Scan() {
+    fields := strings.Fields(scan.Text())
+    if len(fields) != 3 {
+      // a torn final record from a crash
+      continue
+    }
+
+    switch fields[0] {
+    case "use":
+      if n, err := strconv.Atoi(fields[2]); err == nil && n > ind.uses[fields[1]] {
+        ind.uses[fields[1]] = n
+      }
+    case "revoke":
+      ind.addRevocation(fields[1], fields[2])
+    case "put":
+      ind.puts[fields[2]] = fields[1]
+    }
+  }
+  return scan.Err()
+}
+
+// compactLog atomically rewrites the log at path with one record per
+// share use count, revocation and shared put.
+func (ind *ShareIndex) compactLog(path string) error {
+  if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+    return err
+  }
+
+  tmp := path + ".tmp"
+  f, err := os.OpenFile(tmp, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0600)
+  if err != nil {
+    return err
+  }
+
+  w := bufio.NewWriter(f)
+  for ref, n := range ind.uses {
+    fmt.Fprintf(w, "use %v %v\n", ref, n)
+  }
+  for ref, revs := range ind.revoked {
+    for _, rev := range revs {
+      fmt.Fprintf(w, "revoke %v %v\n", ref, rev)
+    }
+  }
+  for ref, shareRef := range ind.puts {
+    fmt.Fprintf(w, "put %v %v\n", shareRef, ref)
+  }
+
+  if err := w.Flush(); err != nil {
+    f.Close()
+    return err
+  } else if err := f.Sync(); err != nil {
+    f.Close()
+    return err
+  } else if err := f.Close(); err != nil {
+    return err
+  }
+  return os.Rename(tmp, path)
+}
+
+// record durably appends a record to the log (if one is open). ind.lock
+// must be held.
+func (ind *ShareIndex) record(format string, v ...interface{}) error {
+  if ind.log == nil {
+    return nil
+  }
+  if _, err := fmt.Fprintf(ind.log, format + "\n", v...); err != nil {
+    return err
+  }
+  return ind.log.Sync()
+}
@@ -0,0 +1,80 @@
+package blobserv
+
+import (
+  "fmt"
+  "bufio"
+  "strings"
+  "net/http"
+  "encoding/json"
+  "github.com/rwcarlsen/cas/blob"
+)
+
+// SizeField reports a blob's size in response to HEAD /ref/<ref>.
+const SizeField = "Blob-Size"
+
+// BlobStat reports whether the blobserver has a ref and its size.
+type BlobStat struct {
+  Ref string
+  Exists bool
+  Size int64 `json:",omitempty"`
+}
+
+// head responds to a HEAD /ref/<ref> request with 200 and the blob's size
+// if it exists and 404 otherwise.
+func (h *getHandler) head(w http.ResponseWriter, ref string) {
+  size, err := h.bs.Db.Stat(ref)
+  if err != nil {
+    w.WriteHeader(http.StatusNotFound)
+    return
+  }
+  w.Header().Set(SizeField, fmt.Sprint(size))
+  w.Header().Set(ActionStatus, ActionSuccess)
+}
+
+// statHandler reports the existence and size of each of the newline
+// separated refs in a request body as a json list of BlobStats.
+type statHandler struct {
+  bs *Server
+}
+
+func (h *statHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+  defer func() {
+    if r := recover(); r != nil {
+      sendErr(w, r)
+      fmt.Println("blob stat failed: ", r)
+    }
+  }()
+
+  stats := []*BlobStat{}
+  scan := bufio.NewScanner(req.Body)
+  for scan.Scan() {
+    ref := strings.TrimSpace(scan.Text())
+    if ref == "" {
+      continue
+    } else if len(stats) == MaxBatch {
+      panic(BadRequestErr)
+    } else if _, _, err := blob.ParseRef(ref); err != nil {
+      panic(err)
+    }
+
+    st := &BlobStat{Ref: ref}
+    if size, err := h.bs.Db.Stat(ref); err == nil {
+      st.Exists, st.Size = true, size
+    }
+    stats = append(stats, st)
+  }
+  if scan.Err() != nil {
+    panic(BadRequestErr)
+  }
+
+  data, err := json.Marshal(stats)
+  if err != nil {
+    panic(err)
+  }
+  w.Header().Set(ActionStatus, ActionSuccess)
+  w.Write(data)
+}
+
+func (h *statHandler) Unauthorized(w http.ResponseWriter, req *http.Request) {
+  deny(w, req)
+}
@@ -0,0 +1,327 @@
+package blobserv
+
+import (
+  "os"
+  "time"
+  "bytes"
+  "bufio"
+  "errors"
+  "strings"
+  "strconv"
+  "encoding/gob"
+  "path/filepath"
+  "github.com/rwcarlsen/cas/blob"
+  "github.com/rwcarlsen/cas/blobserv/index"
+)
+
+const (
+  IndexDir = ".index"
+  // ShareLogName is the conventional name of the share state log (see
+  // OpenShareLog) within a database directory.
+  ShareLogName = ".shares"
+  DefaultCheckpointInterval = 5 * time.Minute
+  journalPrefix = "journal."
+  stateName = "state"
+  // stateVersion changes whenever saved index state changes format so
+  // older checkpoints are rebuilt instead of loaded.
+  stateVersion = 2
+)
+
+var BadCheckpointErr = errors.New("blobserv: index checkpoint has an unknown format")
+
+// checkpoint is the persisted state of every index. Blobs stored after it
+// was saved are listed in the journal numbered Journal.
+type checkpoint struct {
+  Version int
+  Journal int
+  Indexes map[string][]byte
+}
+
+// journal is an append-only log of the refs of blobs stored by the
+// server since the last checkpoint. Each checkpoint starts a new journal
+// and removes the one it covers.
+type journal struct {
+  f *os.File
+  size int64
+}
+
+func journalPath(dir string, n int) string {
+  return filepath.Join(dir, journalPrefix + strconv.Itoa(n))
+}
+
+// createJournal creates an empty journal at pth.
+func createJournal(pth string) (*journal, error) {
+  f, err := os.OpenFile(pth, os.O_WRONLY | os.O_APPEND | os.O_CREATE | os.O_TRUNC, 0644)
+  if err != nil {
+    return nil, err
+  }
+  return &journal{f: f}, nil
+}
+
+// append durably records ref before its blob is stored.
+func (j *journal) append(ref string) error {
+  n, err := j.f.Write([]byte(ref + "\n"))
+  j.size += int64(n)
+  if err != nil {
+    return err
+  }
+  return j.f.Sync()
+}
+
+// readJournal returns the refs in the journal at pth. A ref torn by a
+// crash is returned as is - it won't name a stored blob.
+func readJournal(pth string) ([]string, error) {
+  f, err := os.Open(pth)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+
+  refs := []string{}
+  scan := bufio.NewScanner(f)
+  for scan.Scan() {
+    if ref := strings.TrimSpace(scan.Text()); ref != "" {
+      refs = append(refs, ref)
+    }
+  }
+  return refs, scan.Err()
+}
+
+// Reindex rebuilds every index from scratch by walking the entire
+// database.
+func (bs *Server) Reindex() {
+  for b := range bs.Db.Walk() {
+    bs.notify(b)
+  }
+  bs.sortIndexes()
+}
+
+func (bs *Server) sortIndexes() {
+  for _, ind := range bs.inds {
+    if s, ok := ind.(index.Sorter); ok {
+      s.Sort()
+    }
+  }
+}
+
+// LoadIndexes restores the indexes from the state persisted in dir and
+// replays only the blobs put since the last checkpoint. A full rebuild
+// is done instead if reindex is true, there is no usable saved state or
+// any index is not index.Persistent. Blobs added to the database other than
+// through the server are only picked up by a full rebuild.
+//
+// Index state is then checkpointed to dir every CheckpointInterval while
+// the server runs.
+func (bs *Server) LoadIndexes(dir string, reindex bool) error {
+  if err := os.MkdirAll(dir, 0744); err != nil {
+    return err
+  }
+
+  bs.lock.Lock()
+  defer bs.lock.Unlock()
+  bs.stateDir = dir
+
+  if reindex || bs.replay() != nil {
+    bs.Reindex()
+  }
+
+  // covers everything replayed or walked and starts a new journal
+  if err := bs.checkpoint(); err != nil {
+    return err
+  }
+
+  go bs.checkpointLoop()
+  return nil
+}
+
+// DropIndexState removes the index state saved in dir so the next
+// LoadIndexes rebuilds every index. Use it after removing blobs from the
+// database other than through a server (e.g. with gc).
+func DropIndexState(dir string) error {
+  err := os.Remove(filepath.Join(dir, stateName))
+  if err != nil && !os.IsNotExist(err) {
+    return err
+  }
+  return removeJournals(dir, -1)
+}
+
+// removeJournals removes every journal in dir but number keep.
+func removeJournals(dir string, keep int) error {
+  names, err := filepath.Glob(filepath.Join(dir, journalPrefix + "*"))
+  if err != nil {
+    return err
+  }
+  // the single journal of older versions
+  names = append(names, filepath.Join(dir, "journal"))
+  for _, name := range names {
+    if name != journalPath(dir, keep) {
+      if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+        return err
+      }
+    }
+  }
+  return nil
+}
+
+// replay loads saved index state and notifies the indexes of blobs
+// journaled after it was saved.
+func (bs *Server) replay() error {
+  f, err := os.Open(filepath.Join(bs.stateDir, stateName))
+  if err != nil {
+    return err
+  }
+  defer f.Close()
+
+  cp := &checkpoint{}
+  if err := gob.NewDecoder(f).Decode(cp); err != nil {
+    return err
+  } else if cp.Version != stateVersion {
+    return BadCheckpointErr
+  }
+  bs.journalNum = cp.Journal
+
+  refs, err := readJournal(journalPath(bs.stateDir, cp.Journal))
+  if err != nil {
+    return err
+  }
+
+  // check every index before loading any so a fallback rebuild doesn't
+  // notify indexes that already hold saved state (e.g. after an index is
+  // added)
+  for name, ind := range bs.inds {
+    _, ok := ind.(index.Persistent)
+    if _, saved := cp.Indexes[name]; !ok || !saved {
+      return errors.New("blobserv: no saved state for index " + name)
+    }
+  }
+
+  for name, ind := range bs.inds {
+    if err := ind.(index.Persistent).Load(bytes.NewReader(cp.Indexes[name])); err != nil {
+      return err
+    }
+  }
+
+  // refs are journaled before their blobs are stored, so some may be
+  // missing or listed twice
+  blobs := []*blob.Blob{}
+  seen := map[string]bool{}
+  for _, ref := range refs {
+    if seen[ref] {
+      continue
+    }
+    seen[ref] = true
+    if b, err := bs.Db.Get(ref); err == nil {
+      blobs = append(blobs, b)
+    }
+  }
+  bs.notify(blobs...)
+  bs.sortIndexes()
+  return nil
+}
+
+// checkpoint atomically saves the state of every persistent index and
+// starts a new journal, removing the one the state now covers. bs.lock
+// must be held and no stores may be in flight (see store).
+func (bs *Server) checkpoint() error {
+  num := bs.journalNum + 1
+  j, err := createJournal(journalPath(bs.stateDir, num))
+  if err != nil {
+    return err
+  }
+
+  cp := &checkpoint{
+    Version: stateVersion,
+    Journal: num,
+    Indexes: map[string][]byte{},
+  }
+
+  for name, ind := range bs.inds {
+    p, ok := ind.(index.Persistent)
+    if !ok {
+      continue
+    }
+    var buf bytes.Buffer
+    if err := p.Save(&buf); err != nil {
+      j.f.Close()
+      return err
+    }
+    cp.Indexes[name] = buf.Bytes()
+  }
+
+  pth := filepath.Join(bs.stateDir, stateName)
+  tmp := pth + ".tmp"
+  f, err := os.Create(tmp)
+  if err != nil {
+    j.f.Close()
+    return err
+  }
+
+  err = gob.NewEncoder(f).Encode(cp)
+  if err == nil {
+    err = f.Sync()
+  }
+  if cerr := f.Close(); err == nil {
+    err = cerr
+  }
+  if err == nil {
+    err = os.Rename(tmp, pth)
+  }
+  if err != nil {
+    os.Remove(tmp)
+    j.f.Close()
+    return err
+  }
+
+  if bs.journal != nil {
+    bs.journal.f.Close()
+  }
+  bs.journal, bs.journalNum = j, num
+  return removeJournals(bs.stateDir, num)
+}
+
+func (bs *Server) checkpointLoop() {
+  interval := bs.CheckpointInterval
+  if interval <= 0 {
+    interval = DefaultCheckpointInterval
+  }
+
+  for _ = range time.Tick(interval) {
+    bs.putLock.Lock()
+    bs.lock.Lock()
+    if bs.journal.size > 0 {
+      bs.checkpoint()
+    }
+    bs.lock.Unlock()
+    bs.putLock.Unlock()
+  }
+}
+
+// store journals (if persisting indexes) and stores b, then indexes it
+// and publishes it to subscribers. The ref is journaled first so a crash
+// can't leave a stored blob out of replayed indexes, and checkpoints wait
+// for stores in flight so none is split across a checkpoint.
+func (bs *Server) store(b *blob.Blob) error {
+  bs.putLock.RLock()
+  defer bs.putLock.RUnlock()
+
+  if !bs.Db.Has(b.Ref()) {
+    bs.lock.Lock()
+    if bs.journal != nil {
+      if err := bs.journal.append(b.Ref()); err != nil {
+        bs.lock.Unlock()
+        return err
+      }
+    }
+    bs.lock.Unlock()
+  }
+
+  if err := bs.Db.Put(b); err != nil {
+    return err
+  }
+
+  bs.lock.Lock()
+  defer bs.lock.Unlock()
+  bs.notify(b)
+  bs.feed.publish(b)
+  return nil
+}
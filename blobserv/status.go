@@ -0,0 +1,99 @@
+package blobserv
+
+import (
+  "errors"
+  "net/http"
+  "github.com/rwcarlsen/cas/blob"
+  "github.com/rwcarlsen/cas/blobdb"
+  "github.com/rwcarlsen/cas/auth"
+)
+
+// Errors returned by Client methods for failed requests. Servers signal
+// each with the http status noted.
+var (
+  BadRequestErr = errors.New("blobserv: malformed request") // 400
+  UnauthorizedErr = errors.New("blobserv: authentication required") // 401
+  ForbiddenErr = errors.New("blobserv: access denied") // 403
+  NotFoundErr = errors.New("blobserv: blob or index not found") // 404
+  CollisionErr = errors.New("blobserv: hash collision with a stored blob") // 409
+  TooLargeErr = errors.New("blobserv: blob is larger than MaxBlobSize") // 413
+  RefMismatchErr = errors.New("blobserv: blob content does not match its ref") // 422
+  ServerErr = errors.New("blobserv: internal server error") // 500 and others
+)
+
+// statusFor returns the http status for a request that failed because of
+// v (usually an error recovered from a handler panic).
+func statusFor(v interface{}) int {
+  if _, ok := v.(*blobdb.CorruptBlobError); ok {
+    // it has been quarantined
+    return http.StatusNotFound
+  }
+
+  switch v {
+  case blob.InvalidRefErr, blob.BadPrefixErr, BadRequestErr:
+    return http.StatusBadRequest
+  case blobdb.NotFoundErr, NotFoundErr, UnknownIndexErr:
+    return http.StatusNotFound
+  case blobdb.HashCollideErr, CollisionErr:
+    return http.StatusConflict
+  case TooLargeErr:
+    return http.StatusRequestEntityTooLarge
+  case RefMismatchErr:
+    return http.StatusUnprocessableEntity
+  }
+  return http.StatusInternalServerError
+}
+
+// sendErr marks a request as failed because of v.
+func sendErr(w http.ResponseWriter, v interface{}) {
+  w.Header().Set(ActionStatus, ActionFailed)
+  w.WriteHeader(statusFor(v))
+}
+
+// deny rejects an unauthorized request: with 401 if it is anonymous and
+// 403 if it authenticated (with too low a role) or presented a share or
+// signed url.
+func deny(w http.ResponseWriter, req *http.Request) {
+  w.Header().Set(ActionStatus, ActionFailed)
+  if auth.Identity(req) == "" && req.FormValue("via") == "" && req.FormValue("sig") == "" {
+    auth.SendUnauthorized(w)
+    return
+  }
+  auth.SendForbidden(w)
+}
+
+// checkStatus returns the error matching a failed response's status.
+func checkStatus(resp *http.Response) error {
+  if err := errForStatus(resp.StatusCode); err != nil {
+    return err
+  } else if resp.Header.Get(ActionStatus) == ActionFailed {
+    return ServerErr
+  }
+  return nil
+}
+
+// errForStatus returns the error matching an http status or nil for
+// success.
+func errForStatus(status int) error {
+  switch status {
+  case http.StatusBadRequest:
+    return BadRequestErr
+  case http.StatusUnauthorized:
+    return UnauthorizedErr
+  case http.StatusForbidden:
+    return ForbiddenErr
+  case http.StatusNotFound:
+    return NotFoundErr
+  case http.StatusConflict:
+    return CollisionErr
+  case http.StatusRequestEntityTooLarge:
+    return TooLargeErr
+  case http.StatusUnprocessableEntity:
+    return RefMismatchErr
+  }
+
+  if status >= 300 {
+    return ServerErr
+  }
+  return nil
+}
@@ -2,6 +2,9 @@
 package timeindex
 
 import (
+  "io"
+  "sort"
+  "encoding/gob"
   "io/ioutil"
   "encoding/json"
   "errors"
@@ -66,6 +69,45 @@ func (ti *TimeIndex) Notify(blobs ...*blob.Blob) {
   }
 }
 
+// Sort puts the index entries in chronological order.
+func (ti *TimeIndex) Sort() {
+  sort.Sort(ti)
+}
+
+type timeRecord struct {
+  Tm time.Time
+  Ref string
+}
+
+// Save writes the index entries to w.
+func (ti *TimeIndex) Save(w io.Writer) error {
+  ti.lock.RLock()
+  defer ti.lock.RUnlock()
+
+  recs := make([]timeRecord, len(ti.entries))
+  for i, e := range ti.entries {
+    recs[i] = timeRecord{Tm: e.tm, Ref: e.ref}
+  }
+  return gob.NewEncoder(w).Encode(recs)
+}
+
+// Load replaces the index entries with those written by Save.
+func (ti *TimeIndex) Load(r io.Reader) error {
+  recs := []timeRecord{}
+  if err := gob.NewDecoder(r).Decode(&recs); err != nil {
+    return err
+  }
+
+  ti.lock.Lock()
+  defer ti.lock.Unlock()
+
+  ti.entries = make([]*timeEntry, len(recs))
+  for i, rec := range recs {
+    ti.entries[i] = &timeEntry{tm: rec.Tm, ref: rec.Ref}
+  }
+  return nil
+}
+
 func (ti *TimeIndex) Swap(i, j int) {
   ti.entries[i], ti.entries[j] = ti.entries[j], ti.entries[i]
 }
@@ -0,0 +1,205 @@
+
+package typeindex
+
+import (
+  "io"
+  "sort"
+  "time"
+  "sync"
+  "errors"
+  "net/http"
+  "encoding/gob"
+  "encoding/json"
+  "github.com/rwcarlsen/cas/blob"
+  "github.com/rwcarlsen/cas/blobserv/index"
+)
+
+type Direc int
+
+const (
+  Forward Direc = iota // oldest first
+  Backward // newest first
+)
+
+// Request selects the blobs of one RcasType. Iteration starts at the
+// blob nearest Time in direction Dir (a zero Time starts at the oldest or
+// newest blob).
+type Request struct {
+  Type string
+  Time time.Time
+  Dir Direc
+  SkipN int
+}
+
+type typeEntry struct {
+  tm time.Time
+  ref string
+}
+
+// TypeIndex is a thread-safe index of json blob refs by RcasType, each
+// type in chronological order.
+type TypeIndex struct {
+  types map[string][]*typeEntry
+  unsorted map[string]bool // types notified of blobs out of order
+  lock sync.RWMutex
+}
+
+func New() *TypeIndex {
+  return &TypeIndex{
+    types: map[string][]*typeEntry{},
+    unsorted: map[string]bool{},
+  }
+}
+
+// Notify adds blob refs to the lists for their types.
+//
+// Blobs without an RcasType or timestamp are ignored by TypeIndex.
+func (ti *TypeIndex) Notify(blobs ...*blob.Blob) {
+  ti.lock.Lock()
+  defer ti.lock.Unlock()
+
+  for _, b := range blobs {
+    tp := b.Type()
+    if tp == blob.NoType {
+      continue
+    }
+
+    t, err := b.Timestamp()
+    if err != nil {
+      continue
+    }
+
+    entries := ti.types[tp]
+    if n := len(entries); n > 0 && t.Before(entries[n - 1].tm) {
+      ti.unsorted[tp] = true
+    }
+    ti.types[tp] = append(entries, &typeEntry{tm: t, ref: b.Ref()})
+  }
+}
+
+// Sort puts the entries of every type in chronological order.
+func (ti *TypeIndex) Sort() {
+  ti.lock.Lock()
+  defer ti.lock.Unlock()
+
+  for tp := range ti.unsorted {
+    ti.sort(tp)
+  }
+}
+
+func (ti *TypeIndex) sort(tp string) {
+  entries := ti.types[tp]
+  sort.SliceStable(entries, func(i, j int) bool {
+    return entries[i].tm.Before(entries[j].tm)
+  })
+  delete(ti.unsorted, tp)
+}
+
+// Types returns the number of blobs of each RcasType in the index.
+func (ti *TypeIndex) Types() map[string]int {
+  ti.lock.RLock()
+  defer ti.lock.RUnlock()
+
+  counts := map[string]int{}
+  for tp, entries := range ti.types {
+    counts[tp] = len(entries)
+  }
+  return counts
+}
+
+type typeRecord struct {
+  Type string
+  Tm time.Time
+  Ref string
+}
+
+// Save writes the index entries to w.
+func (ti *TypeIndex) Save(w io.Writer) error {
+  ti.lock.RLock()
+  defer ti.lock.RUnlock()
+
+  recs := []typeRecord{}
+  for tp, entries := range ti.types {
+    for _, e := range entries {
+      recs = append(recs, typeRecord{Type: tp, Tm: e.tm, Ref: e.ref})
+    }
+  }
+  return gob.NewEncoder(w).Encode(recs)
+}
+
+// Load replaces the index entries with those written by Save.
+func (ti *TypeIndex) Load(r io.Reader) error {
+  recs := []typeRecord{}
+  if err := gob.NewDecoder(r).Decode(&recs); err != nil {
+    return err
+  }
+
+  ti.lock.Lock()
+  defer ti.lock.Unlock()
+
+  ti.types = map[string][]*typeEntry{}
+  ti.unsorted = map[string]bool{}
+  for _, rec := range recs {
+    ti.types[rec.Type] = append(ti.types[rec.Type], &typeEntry{tm: rec.Tm, ref: rec.Ref})
+  }
+  return nil
+}
+
+// GetIter returns an iterator over the refs of the type described in the
+// http request.
+func (ti *TypeIndex) GetIter(req *http.Request) (index.Iter, error) {
+  var r Request
+  if err := json.NewDecoder(req.Body).Decode(&r); err != nil || r.Type == "" {
+    return nil, errors.New("typeindex: badly formed query request")
+  }
+
+  ti.lock.Lock()
+  defer ti.lock.Unlock()
+
+  if ti.unsorted[r.Type] {
+    ti.sort(r.Type)
+  }
+
+  // copy the refs so the iterator isn't disturbed by later notifications
+  entries := ti.types[r.Type]
+  refs := make([]string, len(entries))
+  for i, e := range entries {
+    refs[i] = e.ref
+  }
+
+  // first entry not before r.Time
+  at := sort.Search(len(entries), func(i int) bool {
+    return !entries[i].tm.Before(r.Time)
+  })
+
+  it := &iter{refs: refs, at: at, step: 1}
+  if r.Dir == Backward {
+    it.step = -1
+    if r.Time.IsZero() {
+      it.at = len(refs) - 1
+    } else if at == len(entries) || entries[at].tm.After(r.Time) {
+      // last entry not after r.Time
+      it.at--
+    }
+  }
+  it.SkipN(r.SkipN)
+  return it, nil
+}
+
+type iter struct {
+  at int
+  step int
+  refs []string
+}
+
+func (it *iter) Next() (ref string, err error) {
+  if it.at >= 0 && it.at < len(it.refs) {
+    it.at += it.step
+    return it.refs[it.at - it.step], nil
+  }
+  return "", index.IndexEndErr
+}
+
+func (it *iter) SkipN(n int) {
+  it.at += n * it.step
+}
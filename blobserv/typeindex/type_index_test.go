@@ -0,0 +1,92 @@
+package typeindex
+
+import (
+  "fmt"
+  "time"
+  "bytes"
+  "testing"
+  "net/http"
+  "encoding/json"
+  "github.com/rwcarlsen/cas/blob"
+  "github.com/rwcarlsen/cas/blobserv/index"
+)
+
+var start = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// typed returns a blob of type tp timestamped i hours after start.
+func typed(tp string, i int) *blob.Blob {
+  tm := start.Add(time.Duration(i) * time.Hour).Format(blob.TimeFormat)
+  return blob.NewRaw([]byte(fmt.Sprintf(`{"RcasType":%q,"RcasTimestamp":%q,"N":%v}`, tp, tm, i)))
+}
+
+func query(t *testing.T, ti *TypeIndex, r *Request) []string {
+  data, err := json.Marshal(r)
+  if err != nil {
+    t.Fatal(err)
+  }
+  req, err := http.NewRequest("POST", "/index/", bytes.NewReader(data))
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  it, err := ti.GetIter(req)
+  if err != nil {
+    t.Fatal(err)
+  }
+  refs := []string{}
+  for {
+    ref, err := it.Next()
+    if err == index.IndexEndErr {
+      return refs
+    } else if err != nil {
+      t.Fatal(err)
+    }
+    refs = append(refs, ref)
+  }
+}
+
+func TestGetIter(t *testing.T) {
+  notes := []*blob.Blob{}
+  for i := 0; i < 10; i++ {
+    notes = append(notes, typed("note", i))
+  }
+
+  // notify out of order and mixed with another type
+  ti := New()
+  for i := len(notes) - 1; i >= 0; i-- {
+    ti.Notify(notes[i], typed("other", i))
+  }
+  refs := blob.RefsFor(notes)
+
+  tests := []struct {
+    r *Request
+    want []string
+  }{
+    {&Request{Type: "note"}, refs},
+    {&Request{Type: "note", SkipN: 3}, refs[3:]},
+    {&Request{Type: "note", Time: start.Add(4 * time.Hour)}, refs[4:]},
+    {&Request{Type: "note", Time: start.Add(4 * time.Hour + time.Minute), SkipN: 2}, refs[7:]},
+    {&Request{Type: "note", Dir: Backward}, reverse(refs)},
+    {&Request{Type: "note", Dir: Backward, SkipN: 8}, reverse(refs[:2])},
+    {&Request{Type: "note", Dir: Backward, Time: start.Add(4 * time.Hour)}, reverse(refs[:5])},
+    {&Request{Type: "note", Dir: Backward, Time: start.Add(4 * time.Hour + time.Minute), SkipN: 1}, reverse(refs[:4])},
+    {&Request{Type: "note", SkipN: 20}, []string{}},
+    {&Request{Type: "note", Dir: Backward, SkipN: 20}, []string{}},
+    {&Request{Type: "missing"}, []string{}},
+  }
+
+  for i, test := range tests {
+    got := query(t, ti, test.r)
+    if fmt.Sprint(got) != fmt.Sprint(test.want) {
+      t.Errorf("query %v (%+v): got %v refs, want %v", i, test.r, len(got), len(test.want))
+    }
+  }
+}
+
+func reverse(refs []string) []string {
+  rev := make([]string, len(refs))
+  for i, ref := range refs {
+    rev[len(refs) - 1 - i] = ref
+  }
+  return rev
+}
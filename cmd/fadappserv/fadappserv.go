@@ -4,6 +4,7 @@ package main
 import (
   "log"
   "flag"
+  "github.com/rwcarlsen/cas/blobserv"
   "github.com/rwcarlsen/cas/appserv/notedrop"
   "github.com/rwcarlsen/cas/appserv/fupload"
   "github.com/rwcarlsen/cas/appserv/recent"
@@ -12,6 +13,9 @@ import (
 )
 
 var static = flag.String("static", "", "the app server looks for webapp static files here")
+var serv = flag.String("blobserv", "", "blobserver address as user@host (or keyid@host with -key)")
+var passFile = flag.String("passfile", "", "file holding the blobserver password (default $" + blobserv.PassEnv + ")")
+var keyFile = flag.String("key", "", "sign requests with this private key; -blobserv is then keyid@host")
 
 func main() {
   flag.Parse()
@@ -22,13 +26,19 @@ func main() {
 
   appserv.SetStatic(*static)
 
+  c, err := blobserv.NewClient(*serv, *keyFile, *passFile)
+  if err != nil {
+    log.Fatal(err)
+  }
+  appserv.SetClient(c)
+
   //// add new apps by listing them here in this init func
   appserv.RegisterApp("pics", pics.Handler)
   appserv.RegisterApp("notedrop", notedrop.Handler)
   appserv.RegisterApp("recent", recent.Handler)
   appserv.RegisterApp("fupload", fupload.Handler)
 
-  err := appserv.ListenAndServe()
+  err = appserv.ListenAndServe()
   if err != nil {
     log.Fatal(err)
   }
@@ -0,0 +1,57 @@
+
+package main
+
+import (
+  "fmt"
+  "flag"
+  "os"
+  "log"
+  "encoding/json"
+  "github.com/rwcarlsen/cas/blobserv"
+  "github.com/rwcarlsen/cas/blobserv/audit"
+)
+
+var ref = flag.String("ref", "", "only show accesses of this blob")
+var share = flag.String("share", "", "only show accesses through this share")
+var principal = flag.String("user", "", "only show accesses by this user or key id")
+var op = flag.String("op", "", "only show this operation (get, put or index)")
+var result = flag.String("result", "", "only show this result (ok, dup, denied or failed)")
+var max = flag.Int("max", 100, "maximum number of entries to show (0 for all)")
+var keyFile = flag.String("key", "", "sign requests with this private key; the address is then keyid@host")
+var passFile = flag.String("passfile", "", "file holding the blobserver password (default $" + blobserv.PassEnv + ")")
+
+var lg = log.New(os.Stderr, "fadaudit: ", 0)
+
+func main() {
+  flag.Usage = func() {
+    fmt.Fprintln(os.Stderr, "usage: fadaudit [flags] user@host")
+    flag.PrintDefaults()
+  }
+  flag.Parse()
+
+  if flag.NArg() != 1 {
+    flag.Usage()
+    os.Exit(1)
+  }
+  cl, err := blobserv.NewClient(flag.Arg(0), *keyFile, *passFile)
+  if err != nil {
+    lg.Fatalln(err)
+  }
+
+  entries, err := cl.Audit(&audit.Request{
+    Ref: *ref,
+    Share: *share,
+    Principal: *principal,
+    Op: *op,
+    Result: *result,
+    Max: *max,
+  })
+  if err != nil {
+    lg.Fatalln(err)
+  }
+
+  for _, e := range entries {
+    data, _ := json.Marshal(e)
+    fmt.Println(string(data))
+  }
+}
@@ -0,0 +1,138 @@
+
+package main
+
+import (
+  "fmt"
+  "flag"
+  "os"
+  "log"
+  "path/filepath"
+  "github.com/rwcarlsen/cas/blob"
+  "github.com/rwcarlsen/cas/blobdb"
+  "github.com/rwcarlsen/cas/blobserv"
+)
+
+var defaultDB = filepath.Join(os.Getenv("HOME"), ".rcas")
+
+var dbPath = flag.String("db", defaultDB, "path for the blob database to check")
+var store = flag.String("store", blobdb.DirStorage, "storage backend for the blob database (dir or pack)")
+var repair = flag.String("repair", "", "user@host of a blobserver to fetch bad or missing blobs from")
+var keyFile = flag.String("key", "", "sign repair requests with this private key; -repair is then keyid@host")
+var passFile = flag.String("passfile", "", "file holding the -repair blobserver's password (default $" + blobserv.PassEnv + ")")
+
+var lg = log.New(os.Stderr, "fadfsck: ", 0)
+
+var cl *blobserv.Client
+
+func main() {
+  flag.Parse()
+
+  // repairs write to the store, which a running server may be appending to
+  if *repair != "" {
+    lock, err := blobdb.Lock(*dbPath)
+    if err == blobdb.LockedErr {
+      lg.Fatalln("database is in use (stop fadserv first)")
+    } else if err != nil {
+      lg.Fatalln(err)
+    }
+    defer lock.Close()
+  }
+
+  db, err := blobdb.Open(*store, *dbPath)
+  if err != nil {
+    lg.Fatalln(err)
+  }
+
+  if *repair != "" {
+    cl, err = blobserv.NewClient(*repair, *keyFile, *passFile)
+    if err != nil {
+      lg.Fatalln(err)
+    }
+    if err := cl.Dial(); err != nil {
+      lg.Fatalln("Could not connect to blobserver: ", err)
+    }
+  }
+
+  nblobs, nbad, ndangle, nfixed := 0, 0, 0, 0
+  for ref := range db.Enumerate() {
+    nblobs++
+    // only a repair may move corrupt blobs out of the way
+    b, err := db.Verify(ref)
+    if err != nil {
+      nbad++
+      fmt.Println("bad blob", ref + ":", err)
+      if fix(db, ref) {
+        nfixed++
+      }
+      continue
+    }
+
+    for _, link := range links(b) {
+      if db.Has(link) {
+        continue
+      }
+      ndangle++
+      fmt.Println("dangling ref", link, "in meta blob", ref)
+      if fix(db, link) {
+        nfixed++
+      }
+    }
+  }
+
+  fmt.Printf("checked %v blobs: %v bad, %v dangling refs, %v repaired\n", nblobs, nbad, ndangle, nfixed)
+}
+
+// links returns the refs a meta blob depends on.
+func links(b *blob.Blob) []string {
+  if b.Type() != blob.MetaType {
+    return nil
+  }
+
+  m := &blob.Meta{}
+  if err := blob.Unmarshal(b, m); err != nil {
+    return nil
+  }
+
+  refs := append([]string{}, m.ContentRefs...)
+  if m.RcasObjectRef != "" {
+    refs = append(refs, m.RcasObjectRef)
+  }
+  return refs
+}
+
+// fix retrieves ref from the repair blobserver (if any) and stores it in db
+// after verifying its content.
+func fix(db *blobdb.Dbase, ref string) bool {
+  if cl == nil {
+    return false
+  }
+
+  h, _, err := blob.ParseRef(ref)
+  if err != nil {
+    return false
+  }
+
+  b, err := cl.GetBlob(ref)
+  if err != nil {
+    fmt.Println("  could not retrieve", ref, "for repair:", err)
+    return false
+  }
+  b.Hash = h
+
+  if b.Ref() != ref {
+    fmt.Println("  repair copy of", ref, "is also corrupt")
+    return false
+  }
+
+  if err := db.QuarantineBlob(ref); err != nil && err != blobdb.NotFoundErr {
+    fmt.Println("  could not quarantine", ref + ":", err)
+    return false
+  }
+
+  if err := db.Put(b); err != nil && err != blobdb.DupContentErr {
+    fmt.Println("  could not store repaired", ref + ":", err)
+    return false
+  }
+  fmt.Println("  repaired", ref)
+  return true
+}
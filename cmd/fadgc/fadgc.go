@@ -0,0 +1,89 @@
+
+package main
+
+import (
+  "fmt"
+  "flag"
+  "os"
+  "log"
+  "strings"
+  "path/filepath"
+  "github.com/rwcarlsen/cas/blobdb"
+  "github.com/rwcarlsen/cas/blobserv"
+  "github.com/rwcarlsen/cas/blobserv/objindex"
+  "github.com/rwcarlsen/cas/gc"
+)
+
+var defaultDB = filepath.Join(os.Getenv("HOME"), ".rcas")
+
+var dbPath = flag.String("db", defaultDB, "path for the blob database to collect")
+var store = flag.String("store", blobdb.DirStorage, "storage backend for the blob database (dir or pack)")
+var dry = flag.Bool("dry", false, "report garbage without removing anything")
+var grace = flag.Duration("grace", gc.DefaultGrace, "never collect blobs written more recently than this")
+var pin = flag.String("pin", "", "comma separated list of refs to keep regardless of reachability")
+var keepLast = flag.Int("keep-last", 0, "prune all but this many versions of objects with no retention policy (0 keeps all)")
+var verbose = flag.Bool("v", false, "print every collected ref")
+
+var lg = log.New(os.Stderr, "fadgc: ", 0)
+
+func main() {
+  flag.Parse()
+
+  // a running server's indexes would go stale as blobs are removed
+  lock, err := blobdb.Lock(*dbPath)
+  if err == blobdb.LockedErr {
+    lg.Fatalln("database is in use (stop fadserv first)")
+  } else if err != nil {
+    lg.Fatalln(err)
+  }
+  defer lock.Close()
+
+  db, err := blobdb.Open(*store, *dbPath)
+  if err != nil {
+    lg.Fatalln(err)
+  }
+
+  c := gc.New(db)
+  c.Grace = *grace
+  c.DryRun = *dry
+  if *keepLast > 0 {
+    c.Policy = &objindex.Policy{KeepLast: *keepLast}
+  }
+  if *pin != "" {
+    c.Pinned = strings.Split(*pin, ",")
+  }
+
+  rep, err := c.Run()
+  if err != nil {
+    lg.Println(err)
+  }
+  if rep == nil {
+    return
+  }
+
+  if len(rep.Garbage) > 0 && !*dry {
+    // saved index state still lists the removed blobs
+    if err := blobserv.DropIndexState(filepath.Join(*dbPath, blobserv.IndexDir)); err != nil {
+      lg.Println(err)
+    }
+  }
+
+  if *verbose {
+    for _, ref := range rep.Garbage {
+      fmt.Println(ref)
+    }
+  }
+  for _, ref := range rep.Bad {
+    fmt.Println("bad blob", ref)
+  }
+
+  action := "removed"
+  if *dry {
+    action = "would remove"
+  }
+  fmt.Printf("scanned %v blobs, %v reachable, %v too young to collect\n", rep.Scanned, rep.Reachable, rep.Young)
+  if len(rep.Bad) > 0 {
+    fmt.Printf("%v corrupt or unreadable blobs (repair them with fadfsck)\n", len(rep.Bad))
+  }
+  fmt.Printf("%v %v blobs (%v bytes)\n", action, len(rep.Garbage), rep.Bytes)
+}
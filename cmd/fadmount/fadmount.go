@@ -13,6 +13,7 @@ import (
 
 var root = flag.String("root", "./", "retrieved file structure is placed here")
 var prefix = flag.String("prefix", "", "path prefix that is removed before mounting")
+var keyFile = flag.String("key", "", "sign requests with this private key; the address is then keyid@host")
 
 func main() {
   flag.Parse()
@@ -31,13 +32,22 @@ func main() {
 
   tmp := strings.Split(url, "@")
   userPass := strings.Split(tmp[0], ":")
-  if len(userPass) != 2 || len(tmp) != 2 {
+  if len(tmp) != 2 || (*keyFile == "" && len(userPass) != 2) {
     fmt.Println("Invalid blobserver address")
     return
   }
 
   m := mount.New(mountPath)
-  m.ConfigClient(userPass[0], userPass[1], tmp[1])
+  if *keyFile != "" {
+    kf, err := filepath.Abs(*keyFile)
+    if err != nil {
+      fmt.Println(err)
+      return
+    }
+    m.ConfigKey(tmp[0], kf, tmp[1])
+  } else {
+    m.ConfigClient(userPass[0], userPass[1], tmp[1])
+  }
   m.Root, _ = filepath.Abs(*root)
   m.Prefix = *prefix
 
@@ -6,19 +6,133 @@ import (
   "flag"
   "os"
   "log"
+  "strings"
+  "io/ioutil"
   "path/filepath"
+  "github.com/rwcarlsen/cas/blobdb"
   "github.com/rwcarlsen/cas/blobserv"
+  "github.com/rwcarlsen/cas/auth"
+  "github.com/rwcarlsen/cas/blobserv/audit"
 )
 
 var defaultDB = filepath.Join(os.Getenv("HOME"), ".rcas")
+var defaultUsers = filepath.Join(os.Getenv("HOME"), ".rcas-users")
+var defaultKeys = filepath.Join(os.Getenv("HOME"), ".rcas-keys")
+var defaultURLKey = filepath.Join(os.Getenv("HOME"), ".rcas-urlkey")
 
 var dbPath = flag.String("db", defaultDB, "path for the blob database to serve")
 var addr = flag.String("addr", "0.0.0.0:7777", "address the server will listen on")
+var store = flag.String("store", blobdb.DirStorage, "storage backend for the blob database (dir, pack or mem)")
+var compact = flag.Bool("compact", false, "compact a pack database before serving")
+var reindex = flag.Bool("reindex", false, "rebuild all indexes from scratch instead of loading saved index state")
+var usersPath = flag.String("users", defaultUsers, "path of the user store (see fadusers)")
+var keysPath = flag.String("keys", defaultKeys, "path of the keyring of public keys allowed to sign requests")
+var urlKeyPath = flag.String("urlkey", defaultURLKey, "path of the key for signing capability urls (created if missing)")
+var oldURLKeys = flag.String("oldurlkeys", "", "comma separated paths of retired url keys whose urls are still accepted")
+var maxURLTTL = flag.Duration("maxurlttl", blobserv.DefaultMaxURLTTL, "longest time signed urls may stay valid")
+var auditDir = flag.String("audit", "", "directory for the audit log (default <db>/.audit)")
+var noAudit = flag.Bool("noaudit", false, "don't keep an audit log")
+var migrate = flag.Bool("migrate", false, "move blobs in a flat dir database into the sharded layout before serving")
 
 func main() {
+  flag.Parse()
   certFile := filepath.Join(*dbPath, "cert.pem")
   keyFile := filepath.Join(*dbPath, "key.pem")
+
+  us, err := auth.LoadUsers(*usersPath)
+  if err != nil {
+    log.Fatal(err)
+  }
+  auth.SetUsers(us)
+
+  kr, err := auth.LoadKeyring(*keysPath)
+  if err != nil {
+    log.Fatal(err)
+  }
+  auth.SetKeyring(kr)
+
+  if len(us.Users()) == 0 && kr.Len() == 0 {
+    log.Println("warning: no users or keys - only share access is possible (see fadusers)")
+  }
+
+  if *store != blobdb.MemStorage {
+    // keeps fadgc from removing blobs out from under the indexes
+    lock, err := blobdb.Lock(*dbPath)
+    if err != nil {
+      log.Fatal(err)
+    }
+    defer lock.Close()
+  }
+
+  db, err := blobdb.Open(*store, *dbPath)
+  if err != nil {
+    log.Fatal(err)
+  }
+
+  if ds, ok := db.Storage().(*blobdb.DirStore); ok && *migrate {
+    n, err := ds.Migrate()
+    if err != nil {
+      log.Fatal(err)
+    }
+    fmt.Println("migrated", n, "blobs")
+  }
+
+  if ps, ok := db.Storage().(*blobdb.PackStore); ok && *compact {
+    n, err := ps.Compact()
+    if err != nil {
+      log.Fatal(err)
+    }
+    fmt.Println("compaction reclaimed", n, "bytes")
+  }
+
   fmt.Println("running blob server...")
-  log.Fatal(blobserv.ListenAndServeTLS(*addr, *dbPath, certFile, keyFile))
+  bs := blobserv.NewServer(*addr, db)
+  if bs.URLKey, err = loadURLKey(*urlKeyPath); err != nil {
+    log.Fatal(err)
+  }
+  if *oldURLKeys != "" {
+    for _, pth := range strings.Split(*oldURLKeys, ",") {
+      key, err := ioutil.ReadFile(pth)
+      if err != nil {
+        log.Fatal(err)
+      } else if len(key) < 32 {
+        log.Fatal(blobserv.BadURLKeyErr)
+      }
+      bs.OldURLKeys = append(bs.OldURLKeys, key)
+    }
+  }
+  bs.MaxURLTTL = *maxURLTTL
+  if !*noAudit {
+    if *auditDir == "" {
+      *auditDir = filepath.Join(*dbPath, ".audit")
+    }
+    if bs.Audit, err = audit.Open(*auditDir); err != nil {
+      log.Fatal(err)
+    }
+  }
+  if err := bs.OpenShareLog(filepath.Join(*dbPath, blobserv.ShareLogName)); err != nil {
+    log.Fatal(err)
+  }
+  if *store == blobdb.MemStorage {
+    bs.Reindex()
+  } else if err := bs.LoadIndexes(filepath.Join(*dbPath, blobserv.IndexDir), *reindex); err != nil {
+    log.Fatal(err)
+  }
+  log.Fatal(bs.ListenAndServeTLS(certFile, keyFile))
 }
 
+
+// loadURLKey reads the url signing key at pth, creating a new one if the
+// file doesn't exist.
+func loadURLKey(pth string) ([]byte, error) {
+  key, err := ioutil.ReadFile(pth)
+  if os.IsNotExist(err) {
+    key = blobserv.NewURLKey()
+    return key, ioutil.WriteFile(pth, key, 0600)
+  } else if err != nil {
+    return nil, err
+  } else if len(key) < 32 {
+    return nil, blobserv.BadURLKeyErr
+  }
+  return key, nil
+}
@@ -0,0 +1,51 @@
+
+package main
+
+import (
+  "fmt"
+  "flag"
+  "os"
+  "log"
+  "github.com/rwcarlsen/cas/blobserv"
+)
+
+var ttl = flag.Duration("ttl", blobserv.DefaultURLTTL, "how long the link works")
+var obj = flag.Bool("obj", false, "link to the object's whole history instead of just the given ref")
+var keyFile = flag.String("key", "", "sign requests with this private key; the address is then keyid@host")
+var passFile = flag.String("passfile", "", "file holding the blobserver password (default $" + blobserv.PassEnv + ")")
+
+var lg = log.New(os.Stderr, "fadshare: ", 0)
+
+func main() {
+  flag.Usage = func() {
+    fmt.Fprintln(os.Stderr, "usage: fadshare [flags] user@host ref")
+    flag.PrintDefaults()
+  }
+  flag.Parse()
+
+  url, ref := flag.Arg(0), flag.Arg(1)
+  if ref == "" {
+    flag.Usage()
+    os.Exit(1)
+  }
+  cl, err := blobserv.NewClient(url, *keyFile, *passFile)
+  if err != nil {
+    lg.Fatalln(err)
+  }
+
+  objref := ""
+  if *obj {
+    // link to the current version - the url's parameters work for the rest
+    tip, err := cl.ObjectTip(ref)
+    if err != nil {
+      lg.Fatalln(err)
+    }
+    objref, ref = ref, tip.Ref()
+  }
+
+  link, err := cl.SignURL(ref, objref, *ttl)
+  if err != nil {
+    lg.Fatalln(err)
+  }
+  fmt.Println(link)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+  "fmt"
+  "flag"
+  "os"
+  "log"
+  "github.com/rwcarlsen/cas/blobserv"
+  "github.com/rwcarlsen/cas/replica"
+)
+
+var both = flag.Bool("both", false, "also copy blobs only the destination has to the source")
+var rate = flag.Int64("rate", 0, "limit copying to this many KiB per second (0 for unlimited)")
+var follow = flag.Duration("follow", 0, "keep syncing at this interval (e.g. 5m) instead of once")
+var dry = flag.Bool("n", false, "only print the refs that would be copied")
+var quiet = flag.Bool("q", false, "don't print progress")
+var srcKey = flag.String("srckey", "", "sign source requests with this private key; the source is then keyid@host")
+var dstKey = flag.String("dstkey", "", "sign destination requests with this private key; the destination is then keyid@host")
+var srcPass = flag.String("srcpassfile", "", "file holding the source password (default $" + blobserv.PassEnv + ")")
+var dstPass = flag.String("dstpassfile", "", "file holding the destination password (default $" + blobserv.PassEnv + ")")
+
+var lg = log.New(os.Stderr, "fadsync: ", 0)
+
+func main() {
+  flag.Usage = func() {
+    fmt.Fprintln(os.Stderr, "usage: fadsync [flags] user@srchost user@dsthost")
+    flag.PrintDefaults()
+  }
+  flag.Parse()
+
+  if flag.NArg() != 2 {
+    flag.Usage()
+    os.Exit(1)
+  }
+  src, dst := client(flag.Arg(0), *srcKey, *srcPass), client(flag.Arg(1), *dstKey, *dstPass)
+
+  if *dry {
+    onlySrc, onlyDst, err := replica.Diff(src, dst)
+    if err != nil {
+      lg.Fatalln(err)
+    }
+    for _, st := range onlySrc {
+      fmt.Println("->", st.Ref)
+    }
+    if *both {
+      for _, st := range onlyDst {
+        fmt.Println("<-", st.Ref)
+      }
+    }
+    return
+  }
+
+  r := &replica.Replicator{Src: src, Dst: dst, Both: *both, Rate: *rate * 1024}
+  if !*quiet {
+    r.Log = lg
+  }
+
+  if *follow > 0 {
+    r.Follow(*follow, nil)
+    return
+  }
+
+  rep, err := r.Sync()
+  if err != nil {
+    lg.Fatalln(err)
+  }
+  if !*quiet {
+    lg.Printf("done: copied %v blobs (%v back), %v bytes", rep.Copied, rep.CopiedBack, rep.Bytes)
+  }
+}
+
+// client returns a client for addr (user@host or keyid@host if keyFile is
+// not empty).
+func client(addr, keyFile, passFile string) *blobserv.Client {
+  c, err := blobserv.NewClient(addr, keyFile, passFile)
+  if err != nil {
+    lg.Fatalln(addr + ":", err)
+  }
+  return c
+}
@@ -0,0 +1,161 @@
+
+package main
+
+import (
+  "fmt"
+  "flag"
+  "os"
+  "log"
+  "bufio"
+  "strings"
+  "path/filepath"
+  "github.com/rwcarlsen/cas/auth"
+)
+
+var defaultUsers = filepath.Join(os.Getenv("HOME"), ".rcas-users")
+var defaultKeys = filepath.Join(os.Getenv("HOME"), ".rcas-keys")
+
+var usersPath = flag.String("users", defaultUsers, "path of the user store to manage")
+var keysPath = flag.String("keys", defaultKeys, "path of the keyring of public keys allowed to sign requests")
+var role = flag.String("role", "read", "role for added users or the set-role command (guest, read, write or admin)")
+
+var lg = log.New(os.Stderr, "fadusers: ", 0)
+
+const usage = `usage: fadusers [flags] <command> [args]
+
+commands:
+  list                 list users and their roles
+  add <user>           add a user, prompting for a password
+  rm <user>            remove a user
+  passwd <user>        reset a user's password, prompting for the new one
+  role <user>          set a user's role to the -role flag
+  keygen <file>        write a new private key to file and print its public key
+  addkey <id> <pubkey> authorize pubkey to sign requests as id with the -role flag
+`
+
+func main() {
+  flag.Usage = func() {
+    fmt.Fprint(os.Stderr, usage)
+    flag.PrintDefaults()
+  }
+  flag.Parse()
+
+  switch flag.Arg(0) {
+  case "keygen":
+    keygen(flag.Arg(1))
+    return
+  case "addkey":
+    addKey(flag.Arg(1), flag.Arg(2))
+    return
+  }
+
+  us, err := auth.LoadUsers(*usersPath)
+  if err != nil {
+    lg.Fatalln(err)
+  }
+
+  cmd, name := flag.Arg(0), flag.Arg(1)
+  if cmd != "list" && name == "" {
+    flag.Usage()
+    os.Exit(1)
+  }
+
+  switch cmd {
+  case "list":
+    for _, u := range us.Users() {
+      fmt.Printf("%v\t%v\n", u.Name, u.Role)
+    }
+    return
+  case "add":
+    err = us.Add(name, readPass(), parseRole())
+  case "rm":
+    err = us.Remove(name)
+  case "passwd":
+    err = us.SetPassword(name, readPass())
+  case "role":
+    err = us.SetRole(name, parseRole())
+  default:
+    flag.Usage()
+    os.Exit(1)
+  }
+
+  if err != nil {
+    lg.Fatalln(err)
+  } else if err := us.Save(); err != nil {
+    lg.Fatalln(err)
+  }
+}
+
+func keygen(pth string) {
+  if pth == "" {
+    flag.Usage()
+    os.Exit(1)
+  }
+
+  f, err := os.OpenFile(pth, os.O_WRONLY | os.O_CREATE | os.O_EXCL, 0600)
+  if err != nil {
+    lg.Fatalln(err)
+  }
+  defer f.Close()
+
+  key, err := auth.GenerateKey(f)
+  if err != nil {
+    lg.Fatalln(err)
+  }
+  pub, err := auth.MarshalPublicKey(key.Public())
+  if err != nil {
+    lg.Fatalln(err)
+  }
+  fmt.Println(pub)
+}
+
+func addKey(id, pub string) {
+  if id == "" || pub == "" {
+    flag.Usage()
+    os.Exit(1)
+  }
+  if _, err := auth.ParsePublicKey(pub); err != nil {
+    lg.Fatalln(err)
+  }
+  r := parseRole()
+
+  kr, err := auth.LoadKeyring(*keysPath)
+  if err != nil {
+    lg.Fatalln(err)
+  } else if kr.Has(id) {
+    lg.Fatalln("key id", id, "already in keyring")
+  }
+
+  f, err := os.OpenFile(*keysPath, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0600)
+  if err != nil {
+    lg.Fatalln(err)
+  }
+  defer f.Close()
+
+  if _, err := fmt.Fprintf(f, "%v %v %v\n", id, r, pub); err != nil {
+    lg.Fatalln(err)
+  }
+}
+
+func parseRole() auth.Role {
+  r, err := auth.ParseRole(*role)
+  if err != nil {
+    lg.Fatalln(err)
+  }
+  return r
+}
+
+// readPass reads a password from the first line of stdin.
+func readPass() string {
+  fmt.Fprint(os.Stderr, "password: ")
+  line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+  if err != nil && line == "" {
+    lg.Fatalln("no password given")
+  }
+
+  pass := strings.TrimRight(line, "\r\n")
+  if pass == "" {
+    lg.Fatalln("empty password")
+  }
+  return pass
+}
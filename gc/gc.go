@@ -0,0 +1,180 @@
+// gc removes blobs that are no longer reachable from a set of roots.
+//
+// Roots are the versions of every object retained by its retention policy
+// (see objindex.Policy), share blobs, stand-alone json blobs that belong to
+// no object (e.g. notes) and any explicitly pinned refs. Everything
+// reachable from a root by following ContentRefs, RcasObjectRef and share
+// TargetRefs is kept - the rest is swept. Pruned versions and file chunks
+// referenced only by pruned versions are therefore reclaimed.
+//
+// Corrupt or unreadable blobs may be metas whose links can't be read, so
+// nothing is swept while any are present (see fadfsck for repairing them).
+package gc
+
+import (
+  "time"
+  "errors"
+  "github.com/rwcarlsen/cas/blob"
+  "github.com/rwcarlsen/cas/blobdb"
+  "github.com/rwcarlsen/cas/blobserv/objindex"
+)
+
+const DefaultGrace = 24 * time.Hour
+
+var BadBlobsErr = errors.New("gc: corrupt or unreadable blobs found - nothing was swept")
+
+// links holds the fields of a json blob that reference other blobs.
+type links struct {
+  ContentRefs []string
+  RcasObjectRef string
+  TargetRefs []string
+}
+
+func (l *links) refs() []string {
+  refs := append([]string{}, l.ContentRefs...)
+  refs = append(refs, l.TargetRefs...)
+  if l.RcasObjectRef != "" {
+    refs = append(refs, l.RcasObjectRef)
+  }
+  return refs
+}
+
+// Report summarizes a collection run.
+type Report struct {
+  Scanned int
+  Reachable int
+  // Garbage holds the refs that were removed (or would be for a dry run).
+  Garbage []string
+  // Bytes is the total size of the Garbage blobs.
+  Bytes int64
+  // Young counts unreachable blobs kept because they were written within
+  // the grace period.
+  Young int
+  // Bad holds the refs of corrupt or unreadable blobs.
+  Bad []string
+}
+
+type Collector struct {
+  Db *blobdb.Dbase
+  // Pinned refs are always treated as roots.
+  Pinned []string
+  // Policy is used for objects without a retention policy of their own.
+  // Nil retains every version of such objects.
+  Policy *objindex.Policy
+  // Grace protects unreachable blobs written less than Grace ago so chunks
+  // of in-flight uploads aren't collected before their meta blob arrives.
+  Grace time.Duration
+  // DryRun reports garbage without removing anything.
+  DryRun bool
+}
+
+func New(db *blobdb.Dbase) *Collector {
+  return &Collector{
+    Db: db,
+    Grace: DefaultGrace,
+  }
+}
+
+// Run performs a full mark and sweep of the collector's database.
+func (c *Collector) Run() (*Report, error) {
+  rep := &Report{Garbage: []string{}, Bad: []string{}}
+
+  refs := []string{}
+  linked := map[string][]string{}
+  objects := objindex.New()
+  objects.DefaultPolicy = c.Policy
+  roots := append([]string{}, c.Pinned...)
+
+  for ref := range c.Db.Enumerate() {
+    refs = append(refs, ref)
+    // Get would quarantine corrupt blobs, even for dry runs
+    b, err := c.Db.Verify(ref)
+    if err != nil {
+      rep.Bad = append(rep.Bad, ref)
+      continue
+    }
+
+    tp := b.Type()
+    if tp == blob.NoType {
+      continue
+    }
+
+    l := &links{}
+    if err := blob.Unmarshal(b, l); err != nil {
+      continue
+    }
+    linked[ref] = l.refs()
+
+    objects.Notify(b)
+    if l.RcasObjectRef == "" && tp != blob.Object {
+      // shares, retention policies and stand-alone json blobs
+      roots = append(roots, ref)
+    }
+  }
+  rep.Scanned = len(refs)
+
+  objects.Sort()
+  now := time.Now()
+  for _, objref := range objects.ObjectRefs() {
+    pruned := map[string]bool{}
+    for _, ref := range objects.Prunable(objref, now) {
+      pruned[ref] = true
+    }
+
+    for i := 0; i < objects.ObjLen(objref); i++ {
+      ref, _ := objects.RefAt(objref, i)
+      if !pruned[ref] {
+        roots = append(roots, ref)
+      }
+    }
+  }
+
+  marked := mark(roots, linked)
+  if len(rep.Bad) > 0 {
+    for _, ref := range refs {
+      if marked[ref] {
+        rep.Reachable++
+      }
+    }
+    return rep, BadBlobsErr
+  }
+
+  for _, ref := range refs {
+    if marked[ref] {
+      rep.Reachable++
+      continue
+    }
+
+    if t, err := c.Db.ModTime(ref); err != nil || time.Since(t) < c.Grace {
+      rep.Young++
+      continue
+    }
+
+    size, _ := c.Db.Stat(ref)
+    if !c.DryRun {
+      if err := c.Db.Remove(ref); err != nil {
+        return rep, err
+      }
+    }
+    rep.Garbage = append(rep.Garbage, ref)
+    rep.Bytes += size
+  }
+  return rep, nil
+}
+
+// mark returns the set of refs reachable from roots.
+func mark(roots []string, linked map[string][]string) map[string]bool {
+  marked := map[string]bool{}
+  stack := append([]string{}, roots...)
+  for len(stack) > 0 {
+    ref := stack[len(stack) - 1]
+    stack = stack[:len(stack) - 1]
+    if marked[ref] {
+      continue
+    }
+
+    marked[ref] = true
+    stack = append(stack, linked[ref]...)
+  }
+  return marked
+}
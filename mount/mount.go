@@ -18,7 +18,7 @@ import (
 
 var UntrackedErr = errors.New("mount: Illegal operation on untracked file")
 
-const Key = "mount"
+const Key = blob.MountNotesKey
 
 // Meta contains mount-related meta-information that is stored within each
 // Meta's Notes field under Key.
@@ -32,6 +32,9 @@ type Mount struct {
   Root string // Mounted blobs are placed in this directory.
   Refs map[string]string
   Prefix string
+  // Chunker splits snapped files into content blobs. Content-defined
+  // chunking is used so re-snapshots of edited files share unchanged chunks.
+  Chunker *blob.RollingChunker
   PathFor func(*blob.Meta)string `json:"-"`
 }
 
@@ -39,6 +42,7 @@ type Mount struct {
 func New(pathFn func(*blob.Meta)string) *Mount {
   return &Mount{
     PathFor: pathFn,
+    Chunker: blob.NewRollingChunker(),
   }
 }
 
@@ -54,6 +58,10 @@ func Load(pth string) (*Mount, error) {
   if err != nil {
     return nil, err
   }
+  if m.Chunker == nil {
+    // "Chunker": null in the file
+    m.Chunker = blob.NewRollingChunker()
+  }
   return m, nil
 }
 
@@ -85,6 +93,17 @@ func (m *Mount) ConfigClient(user, pass, host string) {
   }
 }
 
+// ConfigKey sets the blobserver client to sign requests with the private
+// key in keyFile (authorized on the server as keyID) so no password needs
+// to be saved with the mount.
+func (m *Mount) ConfigKey(keyID, keyFile, host string) {
+  m.Client = &blobserv.Client{
+    KeyID: keyID,
+    KeyFile: keyFile,
+    Host: host,
+  }
+}
+
 // Unpack mounts files associated with each given ref into the directory
 // specified by Root and the associated Meta's mount meta-data.
 func (m *Mount) Unpack(refs ...string) error {
@@ -96,14 +115,14 @@ func (m *Mount) Unpack(refs ...string) error {
   m.Refs = map[string]string{}
   for _, ref := range refs {
     b, err := m.Client.GetBlob(ref)
-    if err != nil {
+    if err == blobserv.NotFoundErr {
+      return errors.New("mount: no blob " + ref + " on the server")
+    } else if err != nil {
       return err
     }
 
     fm := &blob.Meta{}
     err = blob.Unmarshal(b, fm)
-
-    fm, data, err := m.Client.ReconstituteFile(b.Ref())
     if err != nil {
       return err
     }
@@ -119,8 +138,11 @@ func (m *Mount) Unpack(refs ...string) error {
     if err != nil {
       return err
     }
-    f.Write(data)
+    err = m.Client.WriteContent(fm, f)
     f.Close()
+    if err != nil {
+      return err
+    }
     pth = keyClean(pth)
     m.Refs[pth] = ref
   }
@@ -140,10 +162,6 @@ func (m *Mount) Snap(path string) error {
     newfm = blob.NewMeta()
     obj := blob.NewObject()
     newfm.RcasObjectRef = obj.Ref()
-    chunks, err = newfm.LoadFromPath(path)
-    if err != nil {
-      return err
-    }
 
     mpath := filepath.Dir(filepath.Join(m.Prefix, m.keyPath(path)))
     newfm.SetNotes(Key, &Meta{Path: mpath})
@@ -152,7 +170,16 @@ func (m *Mount) Snap(path string) error {
     return err
   }
 
-  chunks, err = newfm.LoadFromPath(path)
+  if m.Chunker != nil {
+    // a nil *RollingChunker would be a non-nil Chunker
+    newfm.Chunker = m.Chunker
+  }
+  up := m.Client.NewUploader()
+  up.SkipExisting = true
+  err = newfm.StreamFromPath(path, up.Put)
+  if cerr := up.Close(); err == nil {
+    err = cerr
+  }
   if err != nil {
     return err
   }
@@ -163,14 +190,12 @@ func (m *Mount) Snap(path string) error {
   }
   chunks = append(chunks, b)
 
-  m.Refs[path] = b.Ref()
-
-  for _, b := range chunks {
-    err := m.Client.PutBlob(b)
-    if err != nil {
-      return err
-    }
+  // content first so the meta never references missing chunks
+  if err := m.Client.PutBlobs(chunks...); err != nil {
+    return err
   }
+
+  m.Refs[path] = b.Ref()
   return nil
 }
 
@@ -222,7 +247,10 @@ func (m *Mount) getTip(path string) (*blob.Meta, error) {
   var fm = &blob.Meta{}
   if ref, ok := m.Refs[path]; ok {
     b, err := m.Client.GetBlob(ref)
-    if err != nil {
+    if err == blobserv.NotFoundErr {
+      // the tracked version was collected or never made it to the server
+      return nil, UntrackedErr
+    } else if err != nil {
       return nil, err
     }
 
@@ -0,0 +1,249 @@
+// replica keeps blobservers consistent by copying the blobs one has and
+// another doesn't.
+//
+// Ref sets are compared by walking both servers' sorted enumerations (see
+// blobserv.Client.Enumerate) side by side, so neither set has to fit in
+// memory at once - only the differences are kept.
+package replica
+
+import (
+  "log"
+  "time"
+  "github.com/rwcarlsen/cas/blob"
+  "github.com/rwcarlsen/cas/blobserv"
+)
+
+// Diff returns the refs (with sizes) only a has and those only b has.
+func Diff(a, b *blobserv.Client) (onlyA, onlyB []*blobserv.BlobStat, err error) {
+  ea, eb := a.Enumerate(""), b.Enumerate("")
+  ea.Sizes, eb.Sizes = true, true
+
+  sa, err := next(ea)
+  if err != nil {
+    return nil, nil, err
+  }
+  sb, err := next(eb)
+  if err != nil {
+    return nil, nil, err
+  }
+
+  for sa != nil || sb != nil {
+    switch {
+    case sb == nil || (sa != nil && sa.Ref < sb.Ref):
+      onlyA = append(onlyA, sa)
+      sa, err = next(ea)
+    case sa == nil || sb.Ref < sa.Ref:
+      onlyB = append(onlyB, sb)
+      sb, err = next(eb)
+    default:
+      if sa, err = next(ea); err == nil {
+        sb, err = next(eb)
+      }
+    }
+    if err != nil {
+      return nil, nil, err
+    }
+  }
+  return onlyA, onlyB, nil
+}
+
+// next returns the next enumerated ref or nil at the end.
+func next(e *blobserv.Enumerator) (*blobserv.BlobStat, error) {
+  st, err := e.Next()
+  if err == blobserv.EnumEndErr {
+    return nil, nil
+  }
+  return st, err
+}
+
+// Report summarizes a Sync.
+type Report struct {
+  Copied int // blobs copied from Src to Dst
+  CopiedBack int // blobs copied from Dst to Src
+  Bytes int64
+}
+
+// Replicator copies blobs between two blobservers.
+type Replicator struct {
+  Src *blobserv.Client
+  Dst *blobserv.Client
+  // Both also copies blobs only Dst has to Src.
+  Both bool
+  // Rate limits copying to this many bytes per second. Zero is unlimited.
+  Rate int64
+  // Log receives progress messages if it isn't nil.
+  Log *log.Logger
+}
+
+// Sync copies every blob Src has that Dst doesn't (and the reverse if
+// Both is set).
+func (r *Replicator) Sync() (*Report, error) {
+  onlySrc, onlyDst, err := Diff(r.Src, r.Dst)
+  if err != nil {
+    return nil, err
+  }
+
+  rep := &Report{}
+  lim := newLimiter(r.Rate)
+  rep.Copied, err = r.copy(r.Src, r.Dst, onlySrc, lim, rep)
+  if err != nil || !r.Both {
+    return rep, err
+  }
+  rep.CopiedBack, err = r.copy(r.Dst, r.Src, onlyDst, lim, rep)
+  return rep, err
+}
+
+// Follow makes Dst a replica of Src until stop is closed. Blobs Src
+// stores are copied as they arrive through a subscription (see
+// blobserv.Client.Subscribe) and Sync is run every interval to catch
+// anything the subscription missed. Refs arriving during a Sync are
+// drained and copied once it is done so the subscription never falls
+// behind. Failures are logged and retried at the next interval.
+func (r *Replicator) Follow(interval time.Duration, stop <-chan bool) {
+  lim := newLimiter(r.Rate)
+  for {
+    // subscribe before syncing so blobs stored during the sync aren't missed
+    unsub := make(chan bool)
+    refs, err := r.Src.Subscribe("", "", unsub)
+    if err != nil {
+      r.logf("subscribe failed: %v", err)
+    }
+
+    done := make(chan bool, 1)
+    go func() {
+      rep, err := r.Sync()
+      if err != nil {
+        r.logf("sync failed: %v", err)
+      } else if rep.Copied + rep.CopiedBack > 0 {
+        r.logf("copied %v blobs (%v back), %v bytes", rep.Copied, rep.CopiedBack, rep.Bytes)
+      }
+      done <- true
+    }()
+
+    pending := []*blobserv.BlobStat{}
+  syncing:
+    for {
+      select {
+      case ref, ok := <-refs:
+        if !ok {
+          refs = nil
+          continue
+        }
+        pending = append(pending, &blobserv.BlobStat{Ref: ref})
+      case <-done:
+        break syncing
+      case <-stop:
+        close(unsub)
+        return
+      }
+    }
+    if _, err := r.copy(r.Src, r.Dst, pending, lim, &Report{}); err != nil {
+      r.logf("copying blobs stored during sync failed: %v", err)
+    }
+
+    next := time.After(interval)
+  wait:
+    for {
+      select {
+      case ref, ok := <-refs:
+        if !ok {
+          // wait for the next sync to catch up and resubscribe
+          refs = nil
+          continue
+        }
+        if _, err := r.copy(r.Src, r.Dst, []*blobserv.BlobStat{{Ref: ref}}, lim, &Report{}); err != nil {
+          r.logf("copying %v failed: %v", ref, err)
+        }
+      case <-next:
+        break wait
+      case <-stop:
+        close(unsub)
+        return
+      }
+    }
+    close(unsub)
+  }
+}
+
+func (r *Replicator) logf(format string, v ...interface{}) {
+  if r.Log != nil {
+    r.Log.Printf(format, v...)
+  }
+}
+
+// copy retrieves stats' blobs from src and stores them on dst in batches
+// of at most blobserv.DefaultBatchSize blobs and DefaultBatchBytes bytes.
+func (r *Replicator) copy(src, dst *blobserv.Client, stats []*blobserv.BlobStat, lim *limiter, rep *Report) (n int, err error) {
+  for len(stats) > 0 {
+    end, size := 0, int64(0)
+    for end < len(stats) && end < blobserv.DefaultBatchSize {
+      if end > 0 && size + stats[end].Size > blobserv.DefaultBatchBytes {
+        break
+      }
+      size += stats[end].Size
+      end++
+    }
+
+    refs := []string{}
+    for _, st := range stats[:end] {
+      refs = append(refs, st.Ref)
+    }
+    stats = stats[end:]
+
+    lim.wait()
+    blobs, err := src.GetBlobs(refs...)
+    if err != nil {
+      return n, err
+    }
+    for _, b := range blobs {
+      lim.sent += int64(len(b.Content()))
+      rep.Bytes += int64(len(b.Content()))
+    }
+    if err := dst.PutBlobs(rawFirst(blobs)...); err != nil {
+      return n, err
+    }
+
+    n += len(blobs)
+    r.logf("copied %v blobs to %v", n, dst.Host)
+  }
+  return n, nil
+}
+
+// rawFirst orders untyped blobs (e.g. content chunks) ahead of typed ones
+// so metas in a batch are stored after the chunks they reference.
+func rawFirst(blobs []*blob.Blob) []*blob.Blob {
+  sorted := make([]*blob.Blob, 0, len(blobs))
+  for _, b := range blobs {
+    if b.Type() == blob.NoType {
+      sorted = append(sorted, b)
+    }
+  }
+  for _, b := range blobs {
+    if b.Type() != blob.NoType {
+      sorted = append(sorted, b)
+    }
+  }
+  return sorted
+}
+
+// limiter paces transfers to an average number of bytes per second.
+type limiter struct {
+  rate int64
+  start time.Time
+  sent int64 // bytes transferred since start
+}
+
+func newLimiter(rate int64) *limiter {
+  return &limiter{rate: rate, start: time.Now()}
+}
+
+// wait blocks until the bytes sent so far are within the rate.
+func (l *limiter) wait() {
+  if l.rate <= 0 {
+    return
+  }
+  due := time.Duration(float64(l.sent) / float64(l.rate) * float64(time.Second))
+  if d := due - time.Since(l.start); d > 0 {
+    time.Sleep(d)
+  }
+}